@@ -0,0 +1,148 @@
+package ss13_se
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Summary of a scrape and update cycle, as returned by the /admin/scrape route
+type scrapeResult struct {
+	ServerCount int     `json:"serverCount"`
+	Duration    float64 `json:"duration"` // In seconds
+	Error       string  `json:"error,omitempty"`
+
+	// The servers were saved, even if there's an Error from a partial scrape
+	saved bool
+}
+
+// What the updater has been up to, as returned by the /admin/status route.
+// The times are zero if it hasn't happened yet.
+type updaterStatus struct {
+	ScraperDisabled bool      `json:"scraperDisabled"`
+	Scrapes         int       `json:"scrapes"` // Since the start
+	LastScrape      time.Time `json:"lastScrape"`
+	LastSuccess     time.Time `json:"lastSuccess"`
+	LastFailure     time.Time `json:"lastFailure"`
+	LastError       string    `json:"lastError"`    // From the LastFailure
+	LastDuration    float64   `json:"lastDuration"` // In seconds
+	LastServerCount int       `json:"lastServerCount"`
+}
+
+// Remembers the result of the update that started at t
+func (a *App) setUpdaterStatus(t time.Time, res scrapeResult) {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+	s := &a.updater
+	s.Scrapes++
+	s.LastScrape = t
+	s.LastDuration = res.Duration
+	s.LastServerCount = res.ServerCount
+	if res.saved {
+		s.LastSuccess = t
+	}
+	if res.Error != "" {
+		s.LastFailure = t
+		s.LastError = res.Error
+	}
+}
+
+func (a *App) getUpdaterStatus() updaterStatus {
+	a.statusLock.RLock()
+	defer a.statusLock.RUnlock()
+	s := a.updater
+	s.ScraperDisabled = a.conf.DisableScraper
+	return s
+}
+
+// Shows when the updater last succeeded and failed, for debugging it without
+// digging through the logs
+func (a *App) apiAdminStatus(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	return writeJSON(w, http.StatusOK, a.getUpdaterStatus())
+}
+
+// Protects the admin routes, only letting through the requests with the admin
+// credentials from the Conf. The routes are hidden, as if they didn't exist,
+// when there's no credentials set (instead of being open to anyone).
+func (a *App) adminHandler(next http.Handler) http.Handler {
+	return apiHandler(func(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+		if a.conf.AdminToken == "" && a.conf.AdminUser == "" {
+			return HttpError{
+				Status: http.StatusNotFound,
+				Err:    fmt.Errorf("not found"),
+			}
+		}
+		if !a.isAdmin(r) {
+			if a.conf.AdminUser != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			return HttpError{
+				Status: http.StatusUnauthorized,
+				Err:    fmt.Errorf("unauthorized"),
+			}
+		}
+		next.ServeHTTP(w, r)
+		return nil
+	})
+}
+
+// Checks the request's bearer token or basic auth against the Conf, using
+// constant time comparisons so the credentials can't be guessed by timing
+func (a *App) isAdmin(r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return a.conf.AdminToken != "" && secureEqual(token, a.conf.AdminToken)
+	}
+	if user, pass, ok := r.BasicAuth(); ok && a.conf.AdminUser != "" {
+		// Both are always compared, so it doesn't leak which one was wrong
+		u := secureEqual(user, a.conf.AdminUser)
+		p := secureEqual(pass, a.conf.AdminPassword)
+		return u && p
+	}
+	return false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Makes the updater run a scrape right away and waits for its result.
+// Only one can run at a time, so it fails if the updater is already busy.
+// NOTE: a slow scrape can outlast the Conf.WriteTimeout, which cuts the
+// response short (the scrape still finishes).
+func (a *App) apiAdminScrape(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return HttpError{
+			Status: http.StatusMethodNotAllowed,
+			Err:    fmt.Errorf("must be a POST request"),
+		}
+	}
+	if a.conf.DisableScraper {
+		return HttpError{
+			Status: http.StatusServiceUnavailable,
+			Err:    fmt.Errorf("the scraper is disabled"),
+		}
+	}
+
+	// Buffered, so the updater doesn't get stuck if the client gives up
+	reply := make(chan scrapeResult, 1)
+	select {
+	case a.scrapeNow <- reply:
+	default:
+		// The updater only listens while it's waiting between the scrapes
+		return HttpError{
+			Status: http.StatusConflict,
+			Err:    fmt.Errorf("a scrape is already running"),
+		}
+	}
+	select {
+	case res := <-reply:
+		return writeJSON(w, http.StatusOK, res)
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
@@ -0,0 +1,78 @@
+package ss13_se
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	token := Conf{AdminToken: "secret"}
+	basic := Conf{AdminUser: "admin", AdminPassword: "hunter2"}
+	tests := []struct {
+		name   string
+		conf   Conf
+		auth   func(r *http.Request)
+		status int
+	}{
+		{"no credentials configured", Conf{}, func(r *http.Request) {}, http.StatusNotFound},
+		{"no credentials configured, with a token", Conf{}, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer secret")
+		}, http.StatusNotFound},
+		{"missing token", token, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"bad token", token, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer wrong")
+		}, http.StatusUnauthorized},
+		{"good token", token, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer secret")
+		}, http.StatusOK},
+		{"basic auth when only the token is set", token, func(r *http.Request) {
+			r.SetBasicAuth("admin", "secret")
+		}, http.StatusUnauthorized},
+		{"bad user", basic, func(r *http.Request) {
+			r.SetBasicAuth("root", "hunter2")
+		}, http.StatusUnauthorized},
+		{"bad password", basic, func(r *http.Request) {
+			r.SetBasicAuth("admin", "wrong")
+		}, http.StatusUnauthorized},
+		{"good basic auth", basic, func(r *http.Request) {
+			r.SetBasicAuth("admin", "hunter2")
+		}, http.StatusOK},
+		{"token when only basic auth is set", basic, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer hunter2")
+		}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		a := newTestApp(t, tt.conf)
+		r := httptest.NewRequest("GET", "/admin/status", nil)
+		tt.auth(r)
+		w := serve(a, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: missing the WWW-Authenticate header", tt.name)
+		}
+	}
+}
+
+func TestAdminScrapeMethod(t *testing.T) {
+	a := newTestApp(t, Conf{AdminToken: "secret"})
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		r := httptest.NewRequest(method, "/admin/scrape", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := serve(a, r)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: got status %d, want 405", method, w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != "POST" {
+			t.Errorf("%s: got Allow %q, want POST", method, allow)
+		}
+	}
+
+	// The method shouldn't be leaked to an unauthorized client
+	r := httptest.NewRequest("GET", "/admin/scrape", nil)
+	if w := serve(a, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d without a token, want 401", w.Code)
+	}
+}
@@ -0,0 +1,231 @@
+package ss13_se
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// How history is grouped by bucketHistory
+type BucketKind string
+
+const (
+	// By hour of the day, 0 to 23
+	BucketHour BucketKind = "hour"
+	// By day of the week, 0 (Sunday) to 6
+	BucketDay BucketKind = "day"
+)
+
+// Players during a bucket of history, as shown in the average charts
+type HistoryBucket struct {
+	Bucket  int     `json:"bucket"`
+	Avg     float64 `json:"avg"`
+	Peak    int     `json:"peak"`
+	Samples int     `json:"samples"`
+	// The 25th and 75th percentiles, for showing how much the players varies
+	P25 float64 `json:"p25"`
+	P75 float64 `json:"p75"`
+}
+
+// Groups the points by hour or weekday, in loc, and returns the average, peak
+// and percentiles of the players for each bucket. Only buckets with points are
+// returned, with the hours in order and weekdays starting on monday.
+func bucketHistory(points []ServerPoint, kind BucketKind, loc *time.Location) ([]HistoryBucket, error) {
+	var key func(time.Time) int
+	var order []int
+	switch kind {
+	case BucketHour:
+		key = func(t time.Time) int {
+			return t.Hour()
+		}
+		for h := 0; h < 24; h++ {
+			order = append(order, h)
+		}
+	case BucketDay:
+		key = func(t time.Time) int {
+			return int(t.Weekday())
+		}
+		for _, d := range weekDaysOrder {
+			order = append(order, int(d))
+		}
+	default:
+		return nil, fmt.Errorf("unknown bucket kind: %q", kind)
+	}
+
+	sums := make(map[int]int)
+	samples := make(map[int][]int)
+	buckets := make(map[int]*HistoryBucket)
+	for _, p := range points {
+		k := key(p.Time.In(loc))
+		b, found := buckets[k]
+		if !found {
+			b = &HistoryBucket{Bucket: k}
+			buckets[k] = b
+		}
+		sums[k] += p.Players
+		samples[k] = append(samples[k], p.Players)
+		b.Samples++
+		if p.Players > b.Peak {
+			b.Peak = p.Players
+		}
+	}
+
+	var list []HistoryBucket
+	for _, k := range order {
+		b, found := buckets[k]
+		if !found {
+			continue
+		}
+		// Rounded to keep the output readable
+		b.Avg = math.Round(float64(sums[k])/float64(b.Samples)*100) / 100
+		sort.Ints(samples[k])
+		b.P25 = math.Round(Percentile(samples[k], 25)*100) / 100
+		b.P75 = math.Round(Percentile(samples[k], 75)*100) / 100
+		list = append(list, *b)
+	}
+	return list, nil
+}
+
+// Returns the p:th percentile (0 to 100) of the sorted values, interpolating
+// linearly between the closest ones. Zero if there's no values.
+func Percentile(sorted []int, p float64) float64 {
+	if len(sorted) < 1 {
+		return 0
+	}
+	pos := p / 100 * float64(len(sorted)-1)
+	if pos <= 0 {
+		return float64(sorted[0])
+	}
+	i := int(pos)
+	if i >= len(sorted)-1 {
+		return float64(sorted[len(sorted)-1])
+	}
+	frac := pos - float64(i)
+	return float64(sorted[i]) + frac*float64(sorted[i+1]-sorted[i])
+}
+
+// Average and peak players per hour of the day, in loc
+func BucketByHour(points []ServerPoint, loc *time.Location) []HistoryBucket {
+	buckets, _ := bucketHistory(points, BucketHour, loc)
+	return buckets
+}
+
+// Average and peak players per weekday, in loc, starting on monday
+func BucketByDay(points []ServerPoint, loc *time.Location) []HistoryBucket {
+	buckets, _ := bucketHistory(points, BucketDay, loc)
+	return buckets
+}
+
+// Largest allowed window for MovingAverage
+const maxSmoothWindow = 100
+
+// Returns a copy of points with a centered, n-point moving average applied to
+// the players. The window shrinks at the edges, so the ends are still shown.
+// The points must all belong to the same server.
+func MovingAverage(points []ServerPoint, n int) []ServerPoint {
+	if n > maxSmoothWindow {
+		n = maxSmoothWindow
+	}
+	if n < 2 || len(points) < 2 {
+		return points
+	}
+
+	before := (n - 1) / 2
+	after := n - 1 - before
+	smoothed := make([]ServerPoint, len(points))
+	for i, p := range points {
+		start, end := i-before, i+after
+		if start < 0 {
+			start = 0
+		}
+		if end > len(points)-1 {
+			end = len(points) - 1
+		}
+		sum := 0
+		for _, q := range points[start : end+1] {
+			sum += q.Players
+		}
+		p.Players = int(math.Round(float64(sum) / float64(end-start+1)))
+		smoothed[i] = p
+	}
+	return smoothed
+}
+
+// Returns the point with the most players, or false if there's no points.
+// The earliest one is returned if there's multiple peaks.
+func PeakOf(points []ServerPoint) (ServerPoint, bool) {
+	if len(points) < 1 {
+		return ServerPoint{}, false
+	}
+	peak := points[0]
+	for _, p := range points[1:] {
+		if p.Players > peak.Players || (p.Players == peak.Players && p.Time.Before(peak.Time)) {
+			peak = p
+		}
+	}
+	return peak, true
+}
+
+// Estimates the player-hours of the points, as the area under the player
+// curve, using the trapezoidal rule between each pair of following points.
+// Pairs further apart than gap are skipped, as nothing is known about the
+// players while the server (or the scraper) was down. Zero skips none.
+// It's only a rough estimate of the engagement, as it can't tell a few long
+// sessions from many short ones and misses anything between the scrapes.
+// Works for points sorted either way.
+func PlayerHours(points []ServerPoint, gap time.Duration) float64 {
+	sorted := append([]ServerPoint(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+	var total float64
+	for i := 1; i < len(sorted); i++ {
+		dt := sorted[i].Time.Sub(sorted[i-1].Time)
+		if gap > 0 && dt > gap {
+			continue
+		}
+		total += float64(sorted[i].Players+sorted[i-1].Players) / 2 * dt.Hours()
+	}
+	return total
+}
+
+// Average players for each hour of each weekday, indexed by
+// [time.Weekday][hour], as shown in the heatmap
+type heatmap [7][24]HistoryBucket
+
+// Groups the points by weekday and hour, in loc
+func heatmapHistory(points []ServerPoint, loc *time.Location) heatmap {
+	var hm heatmap
+	var sums [7][24]int
+	for _, p := range points {
+		t := p.Time.In(loc)
+		d, h := int(t.Weekday()), t.Hour()
+		b := &hm[d][h]
+		b.Bucket = h
+		b.Samples++
+		sums[d][h] += p.Players
+		if p.Players > b.Peak {
+			b.Peak = p.Players
+		}
+	}
+	for d := range hm {
+		for h := range hm[d] {
+			if b := &hm[d][h]; b.Samples > 0 {
+				b.Avg = math.Round(float64(sums[d][h])/float64(b.Samples)*100) / 100
+			}
+		}
+	}
+	return hm
+}
+
+// Returns the highest average in the heatmap
+func (hm heatmap) max() float64 {
+	var max float64
+	for _, day := range hm {
+		for _, b := range day {
+			max = math.Max(max, b.Avg)
+		}
+	}
+	return max
+}
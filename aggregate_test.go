@@ -0,0 +1,296 @@
+package ss13_se
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func pt(ts string, players int) ServerPoint {
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		panic(err)
+	}
+	return ServerPoint{Time: t, ServerID: "a", Players: players}
+}
+
+func TestBucketHistory(t *testing.T) {
+	plus2 := time.FixedZone("+2", 2*60*60)
+	tests := []struct {
+		name   string
+		points []ServerPoint
+		kind   BucketKind
+		loc    *time.Location
+		want   []HistoryBucket
+	}{
+		{"empty", nil, BucketHour, time.UTC, nil},
+		{
+			"single point",
+			[]ServerPoint{pt("2024-01-01T10:15:00Z", 5)},
+			BucketHour, time.UTC,
+			[]HistoryBucket{{Bucket: 10, Avg: 5, Peak: 5, Samples: 1, P25: 5, P75: 5}},
+		},
+		{
+			"unsorted",
+			[]ServerPoint{
+				pt("2024-01-01T12:00:00Z", 4),
+				pt("2024-01-01T10:30:00Z", 2),
+				pt("2024-01-01T12:30:00Z", 8),
+				pt("2024-01-01T10:00:00Z", 6),
+			},
+			BucketHour, time.UTC,
+			[]HistoryBucket{
+				{Bucket: 10, Avg: 4, Peak: 6, Samples: 2, P25: 3, P75: 5},
+				{Bucket: 12, Avg: 6, Peak: 8, Samples: 2, P25: 5, P75: 7},
+			},
+		},
+		{
+			"gaps across the hours",
+			[]ServerPoint{
+				pt("2024-01-01T10:59:00Z", 3),
+				pt("2024-01-01T11:01:00Z", 5),
+				pt("2024-01-01T23:59:00Z", 1),
+				pt("2024-01-02T00:01:00Z", 7),
+			},
+			BucketHour, time.UTC,
+			[]HistoryBucket{
+				{Bucket: 0, Avg: 7, Peak: 7, Samples: 1, P25: 7, P75: 7},
+				{Bucket: 10, Avg: 3, Peak: 3, Samples: 1, P25: 3, P75: 3},
+				{Bucket: 11, Avg: 5, Peak: 5, Samples: 1, P25: 5, P75: 5},
+				{Bucket: 23, Avg: 1, Peak: 1, Samples: 1, P25: 1, P75: 1},
+			},
+		},
+		{
+			"hours in another timezone",
+			[]ServerPoint{
+				pt("2024-01-01T22:59:00Z", 3),
+				pt("2024-01-01T23:01:00Z", 5),
+			},
+			BucketHour, plus2,
+			[]HistoryBucket{
+				{Bucket: 0, Avg: 3, Peak: 3, Samples: 1, P25: 3, P75: 3},
+				{Bucket: 1, Avg: 5, Peak: 5, Samples: 1, P25: 5, P75: 5},
+			},
+		},
+		{
+			"weekdays starting on monday",
+			[]ServerPoint{
+				pt("2024-01-07T12:00:00Z", 2), // Sunday
+				pt("2024-01-09T12:00:00Z", 4), // Tuesday
+				pt("2024-01-08T12:00:00Z", 6), // Monday
+			},
+			BucketDay, time.UTC,
+			[]HistoryBucket{
+				{Bucket: 1, Avg: 6, Peak: 6, Samples: 1, P25: 6, P75: 6},
+				{Bucket: 2, Avg: 4, Peak: 4, Samples: 1, P25: 4, P75: 4},
+				{Bucket: 0, Avg: 2, Peak: 2, Samples: 1, P25: 2, P75: 2},
+			},
+		},
+		{
+			"weekdays across midnight",
+			[]ServerPoint{
+				pt("2024-01-07T23:59:00Z", 1), // Sunday
+				pt("2024-01-08T00:01:00Z", 3), // Monday
+			},
+			BucketDay, plus2,
+			[]HistoryBucket{
+				{Bucket: 1, Avg: 2, Peak: 3, Samples: 2, P25: 1.5, P75: 2.5},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := bucketHistory(tt.points, tt.kind, tt.loc)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := bucketHistory(nil, "month", time.UTC); err == nil {
+		t.Error("got no error for an unknown bucket kind")
+	}
+}
+
+func TestBucketByHour(t *testing.T) {
+	points := []ServerPoint{
+		pt("2024-01-01T10:00:00Z", 2),
+		pt("2024-01-02T10:00:00Z", 4),
+	}
+	want := []HistoryBucket{{Bucket: 10, Avg: 3, Peak: 4, Samples: 2, P25: 2.5, P75: 3.5}}
+	if got := BucketByHour(points, time.UTC); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := BucketByHour(nil, time.UTC); len(got) > 0 {
+		t.Errorf("got %+v for no points, want none", got)
+	}
+}
+
+func TestBucketByDayDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Skip("missing timezone data:", err)
+	}
+	// The same local times around the sunday when the clocks are changed,
+	// with a different UTC offset before and after
+	tests := []struct {
+		name   string
+		points []ServerPoint
+	}{
+		{"spring", []ServerPoint{
+			pt("2024-03-30T22:30:00Z", 1), // Saturday 23:30 CET
+			pt("2024-03-30T23:30:00Z", 2), // Sunday 00:30 CET
+			pt("2024-03-31T21:30:00Z", 4), // Sunday 23:30 CEST
+			pt("2024-03-31T22:30:00Z", 8), // Monday 00:30 CEST
+		}},
+		{"autumn", []ServerPoint{
+			pt("2024-10-26T21:30:00Z", 1), // Saturday 23:30 CEST
+			pt("2024-10-26T22:30:00Z", 2), // Sunday 00:30 CEST
+			pt("2024-10-27T22:30:00Z", 4), // Sunday 23:30 CET
+			pt("2024-10-27T23:30:00Z", 8), // Monday 00:30 CET
+		}},
+	}
+	want := []HistoryBucket{
+		{Bucket: 1, Avg: 8, Peak: 8, Samples: 1, P25: 8, P75: 8},
+		{Bucket: 6, Avg: 1, Peak: 1, Samples: 1, P25: 1, P75: 1},
+		{Bucket: 0, Avg: 3, Peak: 4, Samples: 2, P25: 2.5, P75: 3.5},
+	}
+	for _, tt := range tests {
+		if got := BucketByDay(tt.points, loc); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []int{10, 20, 30, 40, 50}
+	tests := []struct {
+		sorted []int
+		p      float64
+		want   float64
+	}{
+		{nil, 50, 0},
+		{[]int{7}, 0, 7},
+		{[]int{7}, 50, 7},
+		{[]int{7}, 100, 7},
+		{values, 0, 10},
+		{values, 25, 20},
+		{values, 50, 30},
+		{values, 60, 34},
+		{values, 100, 50},
+		{values, -10, 10},
+		{values, 150, 50},
+	}
+	for _, tt := range tests {
+		if got := Percentile(tt.sorted, tt.p); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Percentile(%v, %v): got %v, want %v", tt.sorted, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestMovingAverage(t *testing.T) {
+	points := []ServerPoint{
+		pt("2024-01-01T10:00:00Z", 1),
+		pt("2024-01-01T10:05:00Z", 2),
+		pt("2024-01-01T10:10:00Z", 3),
+		pt("2024-01-01T10:15:00Z", 4),
+		pt("2024-01-01T10:20:00Z", 5),
+	}
+	tests := []struct {
+		name   string
+		points []ServerPoint
+		n      int
+		want   []int
+	}{
+		{"empty", nil, 3, nil},
+		{"single point", points[:1], 3, []int{1}},
+		{"no window", points, 1, []int{1, 2, 3, 4, 5}},
+		{"window of 3", points, 3, []int{2, 2, 3, 4, 5}},
+		{"window larger than the points", points, 10, []int{3, 3, 3, 3, 3}},
+		{"window over the max", points, maxSmoothWindow * 10, []int{3, 3, 3, 3, 3}},
+	}
+	for _, tt := range tests {
+		got := MovingAverage(tt.points, tt.n)
+		var players []int
+		for i, p := range got {
+			players = append(players, p.Players)
+			if !p.Time.Equal(tt.points[i].Time) {
+				t.Errorf("%s: got time %s for point %d, want %s", tt.name, p.Time, i, tt.points[i].Time)
+			}
+		}
+		if !reflect.DeepEqual(players, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, players, tt.want)
+		}
+	}
+	if points[0].Players != 1 || points[4].Players != 5 {
+		t.Error("the points were modified")
+	}
+}
+
+func TestPeakOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []ServerPoint
+		want   ServerPoint
+		found  bool
+	}{
+		{"empty", nil, ServerPoint{}, false},
+		{"single point", []ServerPoint{pt("2024-01-01T10:00:00Z", 3)}, pt("2024-01-01T10:00:00Z", 3), true},
+		{"unsorted", []ServerPoint{
+			pt("2024-01-01T10:00:00Z", 3),
+			pt("2024-01-01T12:00:00Z", 9),
+			pt("2024-01-01T11:00:00Z", 5),
+		}, pt("2024-01-01T12:00:00Z", 9), true},
+		{"earliest of the peaks", []ServerPoint{
+			pt("2024-01-01T12:00:00Z", 9),
+			pt("2024-01-01T10:00:00Z", 9),
+			pt("2024-01-01T11:00:00Z", 5),
+		}, pt("2024-01-01T10:00:00Z", 9), true},
+	}
+	for _, tt := range tests {
+		got, found := PeakOf(tt.points)
+		if found != tt.found || got.Players != tt.want.Players || !got.Time.Equal(tt.want.Time) {
+			t.Errorf("%s: got %+v %v, want %+v %v", tt.name, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestPlayerHours(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []ServerPoint
+		gap    time.Duration
+		want   float64
+	}{
+		{"empty", nil, 0, 0},
+		{"single point", []ServerPoint{pt("2024-01-01T10:00:00Z", 10)}, 0, 0},
+		{"sorted", []ServerPoint{
+			pt("2024-01-01T10:00:00Z", 10),
+			pt("2024-01-01T11:00:00Z", 20),
+			pt("2024-01-01T12:00:00Z", 0),
+		}, 0, 25},
+		{"unsorted", []ServerPoint{
+			pt("2024-01-01T12:00:00Z", 0),
+			pt("2024-01-01T10:00:00Z", 10),
+			pt("2024-01-01T11:00:00Z", 20),
+		}, 0, 25},
+		{"gap", []ServerPoint{
+			pt("2024-01-01T10:00:00Z", 10),
+			pt("2024-01-01T11:00:00Z", 20),
+			pt("2024-01-01T15:00:00Z", 20),
+		}, 2 * time.Hour, 15},
+		{"no gap", []ServerPoint{
+			pt("2024-01-01T10:00:00Z", 10),
+			pt("2024-01-01T11:00:00Z", 20),
+			pt("2024-01-01T15:00:00Z", 20),
+		}, 0, 95},
+	}
+	for _, tt := range tests {
+		if got := PlayerHours(tt.points, tt.gap); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package ss13_se
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	alertTimeout    = 10 * time.Second
+	alertRetries    = 2
+	alertRetryDelay = 5 * time.Second
+)
+
+type alertPayload struct {
+	ServerID string    `json:"serverID"`
+	Title    string    `json:"title"`
+	Kind     EventKind `json:"kind"`
+	Time     time.Time `json:"time"`
+}
+
+// Sends alerts, in the background, for any of the events belonging to watched
+// servers. The servers are used for looking up the titles.
+func (a *App) sendAlerts(events []ServerEvent, servers []ServerEntry) {
+	if a.conf.AlertWebhookURL == "" || len(a.watched) < 1 {
+		return
+	}
+
+	titles := make(map[string]string)
+	for _, s := range servers {
+		titles[s.ID] = s.Title
+	}
+
+	for _, e := range events {
+		if !a.watched[e.ServerID] {
+			continue
+		}
+		go a.deliverAlert(alertPayload{
+			ServerID: e.ServerID,
+			Title:    titles[e.ServerID],
+			Kind:     e.Kind,
+			Time:     e.Time,
+		})
+	}
+}
+
+func (a *App) deliverAlert(p alertPayload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		a.log.Error("Error encoding alert", "id", p.ServerID, "err", err)
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = a.postAlert(body)
+		if err == nil {
+			return
+		}
+		if attempt >= alertRetries {
+			a.log.Error("Error delivering alert", "id", p.ServerID, "kind", p.Kind, "err", err)
+			return
+		}
+		time.Sleep(alertRetryDelay)
+	}
+}
+
+func (a *App) postAlert(body []byte) error {
+	req, err := http.NewRequest("POST", a.conf.AlertWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", a.conf.ScrapeUserAgent)
+
+	resp, err := a.alertClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bad http.Response.Status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package ss13_se
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+func (a *App) apiServers(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	if _, last := a.getStatus(); notModified(w, r, last) {
+		return nil
+	}
+	servers, err := a.store.GetServers(r.Context())
+	if err != nil {
+		return err
+	}
+
+	q := r.URL.Query()
+	servers = a.removeBlocked(servers)
+	if q.Get("includeHub") != "true" {
+		servers = a.removeHubEntry(servers)
+	}
+	minPlayers, err := parseMinPlayers(q)
+	if err != nil {
+		return err
+	}
+	servers = filterPlayers(servers, minPlayers)
+
+	if err := sortServers(servers, q.Get("sort")); err != nil {
+		return err
+	}
+
+	if servers == nil {
+		servers = []ServerEntry{}
+	}
+	return writeJSON(w, http.StatusOK, servers)
+}
+
+func (a *App) apiServerHistory(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	id := vars["id"]
+	if _, err := a.store.GetServer(r.Context(), id); err == ErrNotFound {
+		return HttpError{
+			Status: http.StatusNotFound,
+			Err:    fmt.Errorf("server not found"),
+		}
+	} else if err != nil {
+		return err
+	}
+
+	q := r.URL.Query()
+	from, to, err := parseTimeRange(q, 1)
+	if err != nil {
+		return err
+	}
+
+	limit := 0
+	if s := q.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return HttpError{
+				Status: http.StatusBadRequest,
+				Err:    fmt.Errorf("invalid limit, must be a positive number"),
+			}
+		}
+	}
+
+	points, err := a.store.GetServerHistoryRange(r.Context(), id, from, to)
+	if err != nil {
+		return err
+	}
+
+	// Points are sorted with the newest first, so this keeps the most recent ones
+	if limit > 0 && len(points) > limit {
+		points = points[:limit]
+	}
+
+	if points == nil {
+		points = []ServerPoint{}
+	}
+	return writeJSON(w, http.StatusOK, points)
+}
+
+func (a *App) apiStats(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	stats := a.getStats()
+	if notModified(w, r, stats.LastScrape) {
+		return nil
+	}
+	return writeJSON(w, http.StatusOK, stats)
+}
+
+// For monitoring how much the history grows, see the retention settings
+func (a *App) apiStorage(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	stats, err := a.store.Stats(r.Context())
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *App) apiLeaderboard(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	servers, _, _, err := a.getLeaderboard(r.Context(), r.URL.Query())
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, servers)
+}
+
+// Returns the same buckets as used by the average charts, as JSON
+func (a *App) apiHistoryBuckets(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	id := vars["id"]
+	if _, err := a.store.GetServer(r.Context(), id); err == ErrNotFound {
+		return HttpError{
+			Status: http.StatusNotFound,
+			Err:    fmt.Errorf("server not found"),
+		}
+	} else if err != nil {
+		return err
+	}
+
+	q := r.URL.Query()
+	kind := BucketKind(q.Get("bucket"))
+	if kind == "" {
+		kind = BucketHour
+	}
+	points, err := a.store.GetSingleServerHistory(r.Context(), id, 30)
+	if err != nil {
+		return err
+	}
+	buckets, err := bucketHistory(points, kind, a.parseTimezone(q))
+	if err != nil {
+		return HttpError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("invalid bucket, must be one of: hour, day"),
+		}
+	}
+
+	if buckets == nil {
+		buckets = []HistoryBucket{}
+	}
+	return writeJSON(w, http.StatusOK, buckets)
+}
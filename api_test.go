@@ -0,0 +1,155 @@
+package ss13_se
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testServers() []ServerEntry {
+	return []ServerEntry{
+		{ID: "b", Title: "Beta Station", GameURL: "byond://beta.example.com:2000", Players: 7},
+		{ID: "a", Title: "Alpha Station", SiteURL: "https://alpha.example.com/", GameURL: "byond://alpha.example.com:1337", Players: 42},
+		{ID: "c", Title: "Gamma Station", GameURL: "byond://gamma.example.com:3000", Players: 0},
+	}
+}
+
+func getServersJSON(t *testing.T, a *App, target string) []ServerEntry {
+	t.Helper()
+	w := get(a, target)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: got status %d, want 200", target, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("GET %s: got content type %q, want application/json", target, ct)
+	}
+	var servers []ServerEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &servers); err != nil {
+		t.Fatalf("GET %s: %s", target, err)
+	}
+	return servers
+}
+
+func serverTitles(servers []ServerEntry) []string {
+	var titles []string
+	for _, s := range servers {
+		titles = append(titles, s.Title)
+	}
+	return titles
+}
+
+func TestAPIServers(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	now := time.Now().Truncate(time.Second)
+	if err := updateTestServers(a, now, testServers()...); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		want   []string
+	}{
+		{"/api/servers", []string{"Alpha Station", "Beta Station", "Gamma Station"}},
+		{"/api/servers?sort=players", []string{"Alpha Station", "Beta Station", "Gamma Station"}},
+		{"/api/servers?sort=title", []string{"Alpha Station", "Beta Station", "Gamma Station"}},
+		{"/api/servers?sort=-title", []string{"Gamma Station", "Beta Station", "Alpha Station"}},
+		{"/api/servers?includeHub=true", []string{internalServerTitle, "Alpha Station", "Beta Station", "Gamma Station"}},
+	}
+	for _, tt := range tests {
+		got := serverTitles(getServersJSON(t, a, tt.target))
+		if len(got) != len(tt.want) {
+			t.Errorf("GET %s: got %v, want %v", tt.target, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("GET %s: got %v, want %v", tt.target, got, tt.want)
+				break
+			}
+		}
+	}
+
+	if w := get(a, "/api/servers?sort=bogus"); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a bad sort, want 400", w.Code)
+	}
+}
+
+func TestAPIServersShape(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	now := time.Now().Truncate(time.Second)
+	if err := updateTestServers(a, now, testServers()[1]); err != nil {
+		t.Fatal(err)
+	}
+	w := get(a, "/api/servers")
+	var servers []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &servers); err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 {
+		t.Fatalf("got %d servers, want 1", len(servers))
+	}
+	s := servers[0]
+	want := map[string]interface{}{
+		"id":      "a",
+		"title":   "Alpha Station",
+		"siteURL": "https://alpha.example.com/",
+		"gameURL": "byond://alpha.example.com:1337",
+		"players": float64(42),
+		"time":    now.Format(time.RFC3339Nano),
+	}
+	for k, v := range want {
+		if got := s[k]; got != v {
+			t.Errorf("got %s %v, want %v", k, got, v)
+		}
+	}
+}
+
+func TestAPIServersEmpty(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	w := get(a, "/api/servers")
+	if body := w.Body.String(); body != "[]\n" {
+		t.Errorf("got body %q, want an empty list", body)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	now := time.Now().Truncate(time.Second)
+	if err := updateTestServers(a, now.Add(-time.Minute), testServers()...); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/", "/api/servers", "/api/stats"} {
+		w := get(a, target)
+		modified := w.Header().Get("Last-Modified")
+		if want := now.Add(-time.Minute).UTC().Format(http.TimeFormat); modified != want {
+			t.Errorf("GET %s: got Last-Modified %q, want %q", target, modified, want)
+			continue
+		}
+
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("If-Modified-Since", modified)
+		if w := serve(a, r); w.Code != http.StatusNotModified || w.Body.Len() > 0 {
+			t.Errorf("GET %s: got status %d with %d bytes, want 304", target, w.Code, w.Body.Len())
+		}
+		r = httptest.NewRequest("GET", target, nil)
+		r.Header.Set("If-Modified-Since", now.Add(-time.Hour).UTC().Format(http.TimeFormat))
+		if w := serve(a, r); w.Code != http.StatusOK {
+			t.Errorf("GET %s: got status %d for an older copy, want 200", target, w.Code)
+		}
+	}
+
+	// There's a newer scrape than the cached copies
+	if err := updateTestServers(a, now, testServers()...); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/", "/api/servers", "/api/stats"} {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("If-Modified-Since", now.Add(-time.Minute).UTC().Format(http.TimeFormat))
+		if w := serve(a, r); w.Code != http.StatusOK {
+			t.Errorf("GET %s: got status %d after a new scrape, want 200", target, w.Code)
+		}
+	}
+}
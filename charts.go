@@ -1,14 +1,18 @@
 package ss13_se
 
 import (
-	"bytes"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
 	"net/http"
-	"sort"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
 	chart "github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
 )
 
 // TODO BUG:
@@ -35,32 +39,313 @@ type renderableChart interface {
 	Render(chart.RendererProvider, io.Writer) error
 }
 
-func (a *App) renderChart(w http.ResponseWriter, c renderableChart) error {
-	buf := &bytes.Buffer{}
-	err := c.Render(chart.PNG, buf)
+// Sets the caching headers for a chart of points and returns true if the
+// client already has the latest version of it, after sending a 304.
+// The data only changes once per scrape, so the ETag is based on the newest
+// point (and the url, for any chart params).
+func (a *App) cachedChart(w http.ResponseWriter, r *http.Request, points []ServerPoint) bool {
+	var latest time.Time
+	for _, p := range points {
+		if p.Time.After(latest) {
+			latest = p.Time
+		}
+	}
+	return a.cachedETag(w, r, latest, len(points))
+}
+
+// Like cachedChart, for anything else that changes once per scrape, with the
+// ETag based on the latest update and some extra number (like a count).
+func (a *App) cachedETag(w http.ResponseWriter, r *http.Request, latest time.Time, n int) bool {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%d|%d", r.URL.RequestURI(), latest.UnixNano(), n)
+	etag := fmt.Sprintf(`"%x"`, h.Sum64())
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(a.conf.ScrapeTimeout.Seconds())))
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// Checks if an If-None-Match header contains etag
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
 
+// Renders the chart as a PNG, in the theme from the optional "theme" query
+// param and with any of the chartOptions params
+func (a *App) renderChart(w http.ResponseWriter, r *http.Request, c renderableChart) error {
+	opts, err := parseChartOptions(r.URL.Query())
 	if err != nil {
-		//a.Log("Error while rendering chart: %s", err)
+		return err
+	}
+	c = opts.apply(themeChart(c, parseTheme(r.URL.Query().Get("theme"))))
+	// Encoding straight to the client, instead of buffering the whole image
+	w.Header().Set("Content-Type", "image/png")
+	cw := &countingWriter{w: w}
+	err = c.Render(chart.PNG, cw)
+	if err == nil {
+		return nil
+	}
+
+	if cw.n == 0 {
+		// Nothing has been sent yet (usually the chart had too few points),
+		// so there's still time for a proper error
+		w.Header().Del("Content-Type")
 		return HttpError{
 			Status: http.StatusInternalServerError,
 			Err:    fmt.Errorf("error while rendering chart"),
 		}
 	}
+	// Too late for an error page, the client simply gets a broken image
+	a.log.Error("Error while sending chart", "err", err)
+	return nil
+}
 
-	w.Header().Add("Content-Type", "image/png")
-	_, err = io.Copy(w, buf)
-	if err != nil {
-		a.Log("Error while sending chart: %s", err)
-		return HttpError{
-			Status: http.StatusInternalServerError,
-			Err:    fmt.Errorf("error while sending chart"),
+// Limits for the chart sizes, so they can't be made too big to render (or
+// too small to show anything)
+const (
+	minChartWidth  = 300
+	maxChartWidth  = 2000
+	minChartHeight = 150
+	maxChartHeight = 1200
+)
+
+var reHexColor = regexp.MustCompile(`^(?:[0-9a-fA-F]{3}){1,2}$`)
+
+// Size and colors of a chart, from the optional "w", "h", "line" and "bg"
+// query params. The colors are hex codes without the "#", like "ff0000".
+// Anything left out keeps the chart's defaults.
+type chartOptions struct {
+	Width  int
+	Height int
+	// Replaces the main color (blue) of the lines and bars
+	Line drawing.Color
+	Bg   drawing.Color
+}
+
+// Parses the chart options, clamping the sizes to the limits above
+func parseChartOptions(q url.Values) (chartOptions, error) {
+	var opts chartOptions
+	size := func(name string, min, max int) (int, error) {
+		v, err := parseIntParam(q, name, 0)
+		if err != nil || v == 0 {
+			return 0, err
 		}
+		if v < min {
+			return min, nil
+		} else if v > max {
+			return max, nil
+		}
+		return v, nil
+	}
+	color := func(name string) (drawing.Color, error) {
+		s := q.Get(name)
+		if s == "" {
+			return drawing.Color{}, nil
+		}
+		if !reHexColor.MatchString(s) {
+			return drawing.Color{}, HttpError{
+				Status: http.StatusBadRequest,
+				Err:    fmt.Errorf("invalid %s, must be a hex color like ff0000", name),
+			}
+		}
+		return drawing.ColorFromHex(s), nil
 	}
 
-	return nil
+	var err error
+	if opts.Width, err = size("w", minChartWidth, maxChartWidth); err != nil {
+		return opts, err
+	}
+	if opts.Height, err = size("h", minChartHeight, maxChartHeight); err != nil {
+		return opts, err
+	}
+	if opts.Line, err = color("line"); err != nil {
+		return opts, err
+	}
+	if opts.Bg, err = color("bg"); err != nil {
+		return opts, err
+	}
+	return opts, nil
 }
 
-func makeHistoryChart(points []ServerPoint, showLegend bool) chart.Chart {
+// Returns the chart with the options applied
+func (o chartOptions) apply(c renderableChart) renderableChart {
+	// Keeps the alpha, for the lighter bands
+	line := func(s chart.Style) chart.Style {
+		if o.Line.IsZero() {
+			return s
+		}
+		if isMainColor(s.StrokeColor) {
+			s.StrokeColor = o.Line.WithAlpha(s.StrokeColor.A)
+		}
+		if isMainColor(s.FillColor) {
+			s.FillColor = o.Line.WithAlpha(s.FillColor.A)
+		}
+		return s
+	}
+	bg := chart.Style{FillColor: o.Bg}
+	switch c := c.(type) {
+	case chart.Chart:
+		c.Width, c.Height = o.Width, o.Height
+		if !o.Bg.IsZero() {
+			c.Background = bg.InheritFrom(c.Background)
+			c.Canvas = bg.InheritFrom(c.Canvas)
+		}
+		var series []chart.Series
+		for _, s := range c.Series {
+			switch s := s.(type) {
+			case chart.TimeSeries:
+				s.Style = line(s.Style)
+				series = append(series, s)
+			case chart.ContinuousSeries:
+				s.Style = line(s.Style)
+				series = append(series, s)
+			case bandSeries:
+				s.Style = line(s.Style)
+				series = append(series, s)
+			default:
+				series = append(series, s)
+			}
+		}
+		c.Series = series
+		return c
+	case chart.BarChart:
+		c.Width, c.Height = o.Width, o.Height
+		if !o.Bg.IsZero() {
+			c.Background = bg.InheritFrom(c.Background)
+			c.Canvas = bg.InheritFrom(c.Canvas)
+		}
+		for i := range c.Bars {
+			c.Bars[i].Style = line(c.Bars[i].Style)
+		}
+		return c
+	}
+	return c
+}
+
+// The charts draws the servers in blue by default, which is also the first of
+// go-chart's default colors
+func isMainColor(c drawing.Color) bool {
+	blue := chart.ColorBlue
+	return !c.IsZero() && c.R == blue.R && c.G == blue.G && c.B == blue.B
+}
+
+// Keeps count of how many bytes has been written
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Max number of points drawn per server in the history charts
+const maxChartPoints = 1000
+
+// Averages the points of a single server into larger buckets, so there's
+// about n of them at most. Keeps the rendering time (and memory) bounded, no
+// matter how much history there is.
+// Returns the size of the buckets too, or zero if the points was left as is.
+func limitPoints(points []ServerPoint, n int) ([]ServerPoint, time.Duration) {
+	if n < 1 || len(points) <= n {
+		return points, 0
+	}
+	first, last := points[0].Time, points[0].Time
+	for _, p := range points {
+		if p.Time.Before(first) {
+			first = p.Time
+		}
+		if p.Time.After(last) {
+			last = p.Time
+		}
+	}
+	span := last.Sub(first)
+	bucket := (span + time.Duration(n) - 1) / time.Duration(n)
+	if bucket < time.Second {
+		return points, 0
+	}
+	return averageHistory(points, bucket), bucket
+}
+
+// Returns the gap threshold for a chart with points spaced by at least
+// bucket, since averaged (or downsampled) history is spread out further than
+// the scrapes. Zero means the lines shouldn't be broken at all.
+func (a *App) chartGap(bucket time.Duration) time.Duration {
+	gap := a.conf.ChartGapThreshold
+	if gap < 0 {
+		return 0
+	}
+	if a.conf.HistoryFullResolution > 0 && a.conf.HistoryDownsampleBucket > bucket {
+		bucket = a.conf.HistoryDownsampleBucket
+	}
+	if 2*bucket > gap {
+		gap = 2 * bucket
+	}
+	return gap
+}
+
+// Splits the points into separate lines wherever the time between two
+// following points is longer than gap. Works for points sorted either way.
+func splitGaps(points []ServerPoint, gap time.Duration) [][]ServerPoint {
+	if gap <= 0 || len(points) < 2 {
+		return [][]ServerPoint{points}
+	}
+	var lines [][]ServerPoint
+	start := 0
+	for i := 1; i < len(points); i++ {
+		d := points[i].Time.Sub(points[i-1].Time)
+		if d < 0 {
+			d = -d
+		}
+		if d > gap {
+			lines = append(lines, points[start:i])
+			start = i
+		}
+	}
+	return append(lines, points[start:])
+}
+
+// Makes a time series per line of points (see splitGaps), with the same
+// style. Only the first one keeps the name, so it's shown once in the legend.
+func gapSeries(name string, points []ServerPoint, gap time.Duration, style chart.Style, yAxis chart.YAxisType) []chart.Series {
+	if len(points) < 1 {
+		return nil
+	}
+	var series []chart.Series
+	for i, line := range splitGaps(points, gap) {
+		var xVals []time.Time
+		var yVals []float64
+		for _, p := range line {
+			xVals = append(xVals, p.Time)
+			yVals = append(yVals, float64(p.Players))
+		}
+		if i > 0 {
+			name = ""
+		}
+		series = append(series, chart.TimeSeries{
+			Name:    name,
+			XValues: xVals,
+			YValues: yVals,
+			YAxis:   yAxis,
+			Style:   style,
+		})
+	}
+	return series
+}
+
+func makeHistoryChart(points []ServerPoint, showLegend bool, gap time.Duration, loc *time.Location) chart.Chart {
 	var xVals []time.Time
 	var yVals []float64
 	for _, p := range points {
@@ -68,18 +353,33 @@ func makeHistoryChart(points []ServerPoint, showLegend bool) chart.Chart {
 		yVals = append(yVals, float64(p.Players))
 	}
 
+	// The whole series is still used for the regression and avg., only the
+	// drawn lines are broken up at the gaps
 	series := chart.TimeSeries{
 		Name:    "Players",
 		XValues: xVals,
 		YValues: yVals,
 	}
+	style := chart.Style{
+		Show:        true,
+		StrokeColor: chart.GetDefaultColor(0),
+	}
 	lr := &chart.LinearRegressionSeries{
 		Name:        "Linear regression",
 		InnerSeries: series,
+		// Keeps the same colors as before the lines could be broken up
+		Style: chart.Style{
+			Show:        true,
+			StrokeColor: chart.GetDefaultColor(1),
+		},
 	}
 	sma := &chart.SMASeries{
 		Name:        "Simple moving avg.",
 		InnerSeries: series,
+		Style: chart.Style{
+			Show:        true,
+			StrokeColor: chart.GetDefaultColor(2),
+		},
 	}
 
 	c := chart.Chart{
@@ -92,7 +392,7 @@ func makeHistoryChart(points []ServerPoint, showLegend bool) chart.Chart {
 			Style: chart.StyleShow(),
 			ValueFormatter: func(v interface{}) string {
 				t := int64(v.(float64))
-				return time.Unix(0, t).Format("Jan 02 15:04")
+				return time.Unix(0, t).In(loc).Format("Jan 02 15:04")
 			},
 		},
 		YAxis: chart.YAxis{
@@ -101,11 +401,7 @@ func makeHistoryChart(points []ServerPoint, showLegend bool) chart.Chart {
 				return fmt.Sprintf("%.0f", v)
 			},
 		},
-		Series: []chart.Series{
-			series,
-			lr,
-			sma,
-		},
+		Series: append(gapSeries("Players", points, gap, style, chart.YAxisPrimary), lr, sma),
 	}
 	if showLegend {
 		c.Elements = []chart.Renderable{
@@ -115,24 +411,97 @@ func makeHistoryChart(points []ServerPoint, showLegend bool) chart.Chart {
 	return c
 }
 
-// NOTE: The chart won't be renderable unless we've got at least two days/hours of history
-func makeAverageChart(values map[int][]int, fnFormat func(int, float64) string, fnSort func([]int) []int) chart.BarChart {
-	var keys []int
-	avg := make(map[int]float64)
-	for i, vl := range values {
-		sum := 0
-		for _, v := range vl {
-			sum += v
+// Marks the highest point of each time series in the chart, with the players
+// and when it happened. The earliest one is used if there's multiple peaks.
+func annotatePeaks(c *chart.Chart, loc *time.Location) {
+	var peaks []chart.Value2
+	var maxY float64
+	for _, s := range c.Series {
+		ts, ok := s.(chart.TimeSeries)
+		if !ok || len(ts.YValues) < 1 {
+			continue
+		}
+		// Unnamed series are the rest of a line broken up at the gaps, so
+		// they share a single peak with the named one before them
+		if ts.Name != "" || len(peaks) < 1 {
+			peaks = append(peaks, chart.Value2{})
+			maxY = -1
+		}
+		max := 0
+		for i, v := range ts.YValues {
+			if v > ts.YValues[max] {
+				max = i
+			}
+		}
+		x, y := ts.GetValues(max)
+		if y <= maxY {
+			continue
+		}
+		maxY = y
+		peaks[len(peaks)-1] = chart.Value2{
+			XValue: x,
+			YValue: y,
+			Label:  fmt.Sprintf("%.0f @ %s", y, ts.XValues[max].In(loc).Format("Jan 02 15:04")),
+			Style:  ts.Style,
+		}
+	}
+	if len(peaks) > 0 {
+		c.Series = append(c.Series, chart.AnnotationSeries{
+			Name:        "Peak",
+			Annotations: peaks,
+		})
+	}
+}
+
+// Draws the history of multiple servers on the same time axis, with a legend.
+// Servers without any history are left out.
+func makeCompareChart(titles []string, points [][]ServerPoint, gap time.Duration, loc *time.Location) chart.Chart {
+	var series []chart.Series
+	for i, pl := range points {
+		if len(pl) < 1 {
+			continue
 		}
-		avg[i] = float64(sum / len(vl))
-		keys = append(keys, i)
+		style := chart.Style{
+			Show:        true,
+			StrokeColor: chart.GetDefaultColor(i),
+		}
+		series = append(series, gapSeries(titles[i], pl, gap, style, chart.YAxisPrimary)...)
 	}
 
+	c := chart.Chart{
+		Background: chart.Style{
+			Padding: chart.Box{
+				Top: 40,
+			},
+		},
+		XAxis: chart.XAxis{
+			Style: chart.StyleShow(),
+			ValueFormatter: func(v interface{}) string {
+				t := int64(v.(float64))
+				return time.Unix(0, t).In(loc).Format("Jan 02 15:04")
+			},
+		},
+		YAxis: chart.YAxis{
+			Style: chart.StyleShow(),
+			ValueFormatter: func(v interface{}) string {
+				return fmt.Sprintf("%.0f", v)
+			},
+		},
+		Series: series,
+	}
+	c.Elements = []chart.Renderable{
+		chart.LegendThin(&c),
+	}
+	return c
+}
+
+// NOTE: The chart won't be renderable unless we've got at least two days/hours of history
+func makeAverageChart(buckets []HistoryBucket, fnFormat func(int, float64) string) chart.BarChart {
 	var bars []chart.Value
-	for _, k := range fnSort(keys) {
+	for _, b := range buckets {
 		bars = append(bars, chart.Value{
-			Label: fnFormat(k, avg[k]),
-			Value: avg[k],
+			Label: fnFormat(b.Bucket, b.Avg),
+			Value: b.Avg,
 			Style: chart.Style{
 				StrokeColor: chart.ColorBlue,
 				FillColor:   chart.ColorBlue,
@@ -141,7 +510,7 @@ func makeAverageChart(values map[int][]int, fnFormat func(int, float64) string,
 	}
 
 	barW, barS := 50, 100
-	if len(avg) > 7 {
+	if len(buckets) > 7 {
 		barW, barS = 20, 20
 	}
 	s := chart.Style{
@@ -162,14 +531,115 @@ func makeAverageChart(values map[int][]int, fnFormat func(int, float64) string,
 	}
 }
 
-// Shortcut/helper func for the calling handler
-func avgDailyChart(points []ServerPoint) chart.BarChart {
-	days := make(map[int][]int)
-	for _, p := range points {
-		d := int(p.Time.Weekday())
-		days[d] = append(days[d], p.Players)
+// Shaded area between the upper and lower values, like the percentile bands
+type bandSeries struct {
+	Name    string
+	Style   chart.Style
+	XValues []float64
+	Upper   []float64
+	Lower   []float64
+}
+
+func (s bandSeries) GetName() string           { return s.Name }
+func (s bandSeries) GetStyle() chart.Style     { return s.Style }
+func (s bandSeries) GetYAxis() chart.YAxisType { return chart.YAxisPrimary }
+func (s bandSeries) Len() int                  { return len(s.XValues) }
+func (s bandSeries) GetBoundedValues(i int) (float64, float64, float64) {
+	return s.XValues[i], s.Upper[i], s.Lower[i]
+}
+
+func (s bandSeries) Validate() error {
+	if len(s.Upper) != len(s.XValues) || len(s.Lower) != len(s.XValues) {
+		return fmt.Errorf("band series must have as many upper and lower values as x values")
 	}
-	now := time.Now()
+	return nil
+}
+
+func (s bandSeries) Render(r chart.Renderer, canvasBox chart.Box, xrange, yrange chart.Range, defaults chart.Style) {
+	if s.Len() < 1 {
+		return
+	}
+	chart.Draw.BoundedSeries(r, canvasBox, xrange, yrange, s.Style.InheritFrom(defaults), s)
+}
+
+// Like makeAverageChart, but draws the averages as a line inside a band from
+// the 25th to the 75th percentile, to show how much the players varies
+func makeBandChart(buckets []HistoryBucket, fnFormat func(int, float64) string) chart.Chart {
+	var xVals, avg, upper, lower []float64
+	// The axis range is taken from the ticks, so the unlabeled ones pads it,
+	// so the first and last buckets aren't on the edges (and a single bucket
+	// still has a range)
+	ticks := []chart.Tick{{Value: -0.5}}
+	max := 1.0
+	for i, b := range buckets {
+		xVals = append(xVals, float64(i))
+		avg = append(avg, b.Avg)
+		upper = append(upper, b.P75)
+		lower = append(lower, b.P25)
+		ticks = append(ticks, chart.Tick{Value: float64(i), Label: fnFormat(b.Bucket, b.Avg)})
+		max = math.Max(max, math.Max(b.Avg, b.P75))
+	}
+	ticks = append(ticks, chart.Tick{Value: float64(len(buckets)) - 0.5})
+
+	c := chart.Chart{
+		Background: chart.Style{
+			Padding: chart.Box{
+				Top: 40,
+			},
+		},
+		XAxis: chart.XAxis{
+			Style: chart.StyleShow(),
+			Ticks: ticks,
+		},
+		YAxis: chart.YAxis{
+			Style: chart.StyleShow(),
+			Range: &chart.ContinuousRange{Min: 0, Max: max * 1.1},
+			ValueFormatter: func(v interface{}) string {
+				return fmt.Sprintf("%.0f", v)
+			},
+		},
+		Series: []chart.Series{
+			bandSeries{
+				Name: "25th to 75th percentile",
+				Style: chart.Style{
+					Show:        true,
+					StrokeColor: chart.ColorBlue.WithAlpha(64),
+					FillColor:   chart.ColorBlue.WithAlpha(48),
+				},
+				XValues: xVals,
+				Upper:   upper,
+				Lower:   lower,
+			},
+			chart.ContinuousSeries{
+				Name:    "Average",
+				XValues: xVals,
+				YValues: avg,
+				Style: chart.Style{
+					Show:        true,
+					StrokeColor: chart.ColorBlue,
+					StrokeWidth: 2,
+				},
+			},
+		},
+	}
+	c.Elements = []chart.Renderable{
+		chart.LegendThin(&c),
+	}
+	return c
+}
+
+// Makes the average chart, with the percentile bands if asked to
+func averageChart(buckets []HistoryBucket, bands bool, fnFormat func(int, float64) string) renderableChart {
+	if bands {
+		return makeBandChart(buckets, fnFormat)
+	}
+	return makeAverageChart(buckets, fnFormat)
+}
+
+// Shortcut/helper func for the calling handler
+func avgDailyChart(points []ServerPoint, bands bool, loc *time.Location) renderableChart {
+	buckets := BucketByDay(points, loc)
+	now := time.Now().In(loc)
 	formatter := func(i int, f float64) string {
 		d := time.Weekday(i)
 		extra := ""
@@ -178,27 +648,13 @@ func avgDailyChart(points []ServerPoint) chart.BarChart {
 		}
 		return fmt.Sprintf("%s%s", d, extra)
 	}
-	sorter := func(keys []int) []int {
-		sort.Slice(keys, func(i, j int) bool {
-			return keys[i] < keys[j]
-		})
-		// Fucking wankers and their fucking sundays
-		if keys[0] == int(time.Sunday) {
-			keys = append(keys[1:], int(time.Sunday))
-		}
-		return keys
-	}
-	return makeAverageChart(days, formatter, sorter)
+	return averageChart(buckets, bands, formatter)
 }
 
 // Shortcut/helper func for the calling handler
-func avgHourlyChart(points []ServerPoint) chart.BarChart {
-	hours := make(map[int][]int)
-	for _, p := range points {
-		h := p.Time.Hour()
-		hours[h] = append(hours[h], p.Players)
-	}
-	now := time.Now()
+func avgHourlyChart(points []ServerPoint, bands bool, loc *time.Location) renderableChart {
+	buckets := BucketByHour(points, loc)
+	now := time.Now().In(loc)
 	formatter := func(i int, f float64) string {
 		extra := ""
 		if i == now.Hour() {
@@ -206,11 +662,5 @@ func avgHourlyChart(points []ServerPoint) chart.BarChart {
 		}
 		return fmt.Sprintf("%02d%s", i, extra)
 	}
-	sorter := func(keys []int) []int {
-		sort.Slice(keys, func(i, j int) bool {
-			return keys[i] < keys[j]
-		})
-		return keys
-	}
-	return makeAverageChart(hours, formatter, sorter)
+	return averageChart(buckets, bands, formatter)
 }
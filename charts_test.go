@@ -0,0 +1,51 @@
+package ss13_se
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChartETag(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	now := time.Now().Truncate(time.Second)
+	server := testServers()[1]
+	for _, d := range []time.Duration{2 * time.Hour, time.Hour} {
+		if err := updateTestServers(a, now.Add(-d), server); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := get(a, "/server/a/daily")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got status %d and ETag %q, want 200 with an ETag", w.Code, etag)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=900" {
+		t.Errorf("got Cache-Control %q, want it aligned with the scrape timeout", got)
+	}
+
+	r := httptest.NewRequest("GET", "/server/a/daily", nil)
+	r.Header.Set("If-None-Match", etag)
+	if w := serve(a, r); w.Code != http.StatusNotModified || w.Body.Len() > 0 {
+		t.Errorf("got status %d with %d bytes, want 304 for a matching ETag", w.Code, w.Body.Len())
+	}
+
+	// Another chart of the same server doesn't share the ETag
+	r = httptest.NewRequest("GET", "/server/a/weekly", nil)
+	r.Header.Set("If-None-Match", etag)
+	if w := serve(a, r); w.Code != http.StatusOK {
+		t.Errorf("got status %d for the weekly chart, want 200", w.Code)
+	}
+
+	// New history changes the ETag
+	if err := updateTestServers(a, now, server); err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("GET", "/server/a/daily", nil)
+	r.Header.Set("If-None-Match", etag)
+	if w := serve(a, r); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("got status %d and ETag %q after an update, want 200 and a new ETag", w.Code, w.Header().Get("ETag"))
+	}
+}
@@ -1,36 +1,72 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/lmas/ss13_se"
 )
 
 var (
-	flagAddr = flag.String("addr", ":8000", "Adress and port to run the web server on")
-	flagPath = flag.String("path", "servers.db", "File path to database")
+	flagAddr     = flag.String("addr", ":8000", "Adress and port to run the web server on")
+	flagPath     = flag.String("path", "servers.db", "File path to database, its dir is created if missing")
+	flagPostgres = flag.String("postgres", "", "Use a PostgreSQL database with this connection string, instead of the file database")
+	flagDev      = flag.Bool("dev", false, "Load templates and static files from the current dir, for live editing")
+	flagQuiet    = flag.Bool("quiet", false, "Turn off the request logging")
+	flagProxy    = flag.String("proxy", "", "Scrape byond through this HTTP proxy")
+	flagTLSCert  = flag.String("tls-cert", "", "Serve HTTPS using this cert file (requires -tls-key)")
+	flagTLSKey   = flag.String("tls-key", "", "Key file for the -tls-cert")
+	flagAutocert = flag.String("autocert", "", "Serve HTTPS using Let's Encrypt certs for these comma separated domains")
+	flagHubs     = flag.String("hubs", "", "Scrape these comma separated byond hubs, instead of only the SS13 one (like \"Exadv1/SpaceStation13\")")
+	flagNoWeb    = flag.Bool("no-web", false, "Only run the scraper, without the web server")
+	flagNoScrape = flag.Bool("no-scrape", false, "Only run the web server, showing what another instance has scraped to a shared database")
+	flagBasePath = flag.String("base-path", "", "Serve the pages under this path, like \"/ss13\", when running behind a reverse proxy")
 )
 
 func main() {
 	flag.Parse()
 
+	var store ss13_se.Storage = ss13_se.NewStorageSqlite(*flagPath)
+	if *flagPostgres != "" {
+		store = ss13_se.NewStoragePostgres(*flagPostgres)
+	}
+
 	// TODO: load config from a toml file
 	conf := ss13_se.Conf{
-		WebAddr:       *flagAddr,
-		ReadTimeout:   30 * time.Second,
-		WriteTimeout:  30 * time.Second,
-		ScrapeTimeout: 15 * time.Minute,
-		Storage: &ss13_se.StorageSqlite{
-			Path: *flagPath,
-		},
+		WebAddr:          *flagAddr,
+		BasePath:         *flagBasePath,
+		ReadTimeout:      30 * time.Second,
+		WriteTimeout:     30 * time.Second,
+		ScrapeTimeout:    15 * time.Minute,
+		Storage:          store,
+		DevMode:          *flagDev,
+		DisableAccessLog: *flagQuiet,
+		ProxyURL:         *flagProxy,
+		TLSCertFile:      *flagTLSCert,
+		TLSKeyFile:       *flagTLSKey,
+		DisableWeb:       *flagNoWeb,
+		DisableScraper:   *flagNoScrape,
+	}
+	if *flagAutocert != "" {
+		conf.AutocertDomains = strings.Split(*flagAutocert, ",")
+	}
+	if *flagHubs != "" {
+		conf.HubSources = strings.Split(*flagHubs, ",")
 	}
 	app, err := ss13_se.New(conf)
 	if err != nil {
 		panic(err)
 	}
 
-	err = app.Run()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = app.Run(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,137 @@
+package ss13_se
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Max number of servers or points saved to the destination at a time
+const copyBatchSize = 5000
+
+// Far enough back to get all the server counts, which can only be fetched by days
+const copyAllDays = 100 * 365
+
+// The Storage.GetMeta keys that are copied, as there's no way to list them.
+// Without them dst would downsample all the history again and resend the
+// digests of the current week.
+var copyMetaKeys = []string{storageMetaDownsampled, metaDigestWeek}
+
+// CopyStorage copies all servers, with their history and events, the server
+// counts and the meta keys from src to dst, like when moving from StorageSqlite
+// to StoragePostgres. Both must already be open.
+//
+// The servers are saved as they are, so dst keeps their FirstSeen and peaks
+// (see SaveServers). It's safe to run again after a failed or interrupted
+// copy, as the history is upserted and any events and counts already in dst
+// are skipped.
+func CopyStorage(ctx context.Context, src, dst Storage) error {
+	servers, err := src.GetServers(ctx)
+	if err != nil {
+		return fmt.Errorf("loading servers: %w", err)
+	}
+	for i := 0; i < len(servers); i += copyBatchSize {
+		end := min(i+copyBatchSize, len(servers))
+		if err := dst.SaveServers(ctx, servers[i:end]); err != nil {
+			return fmt.Errorf("saving servers: %w", err)
+		}
+	}
+
+	now := time.Now()
+	for _, s := range servers {
+		if err := copyHistory(ctx, src, dst, s.ID, now); err != nil {
+			return fmt.Errorf("copying history of %s: %w", s.ID, err)
+		}
+		if err := copyEvents(ctx, src, dst, s.ID); err != nil {
+			return fmt.Errorf("copying events of %s: %w", s.ID, err)
+		}
+	}
+
+	if err := copyCounts(ctx, src, dst); err != nil {
+		return fmt.Errorf("copying server counts: %w", err)
+	}
+	// Last, so the downsampling cursor doesn't get ahead of the history
+	for _, key := range copyMetaKeys {
+		value, err := src.GetMeta(ctx, key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("loading meta %s: %w", key, err)
+		}
+		if err := dst.SaveMeta(ctx, key, value); err != nil {
+			return fmt.Errorf("saving meta %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Copies the history of a single server at a time, so there's never more than
+// one server's history in memory
+func copyHistory(ctx context.Context, src, dst Storage, id string, now time.Time) error {
+	points, err := src.GetServerHistoryRange(ctx, id, time.Time{}, now)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(points); i += copyBatchSize {
+		end := min(i+copyBatchSize, len(points))
+		if err := dst.SaveServerHistory(ctx, points[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyEvents(ctx context.Context, src, dst Storage, id string) error {
+	events, err := src.GetServerEventsSince(ctx, id, time.Time{})
+	if err != nil {
+		return err
+	}
+	old, err := dst.GetServerEventsSince(ctx, id, time.Time{})
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool, len(old))
+	for _, e := range old {
+		found[copyKey(e.Time, string(e.Kind))] = true
+	}
+	var missing []ServerEvent
+	for _, e := range events {
+		if !found[copyKey(e.Time, string(e.Kind))] {
+			missing = append(missing, e)
+		}
+	}
+	if len(missing) < 1 {
+		return nil
+	}
+	return dst.SaveServerEvents(ctx, missing)
+}
+
+func copyCounts(ctx context.Context, src, dst Storage) error {
+	counts, err := src.GetServerCounts(ctx, copyAllDays)
+	if err != nil {
+		return err
+	}
+	old, err := dst.GetServerCounts(ctx, copyAllDays)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool, len(old))
+	for _, c := range old {
+		found[copyKey(c.Time, "")] = true
+	}
+	// There's no batch method for the counts, but there's only one per scrape
+	for _, c := range counts {
+		if found[copyKey(c.Time, "")] {
+			continue
+		}
+		if err := dst.SaveServerCount(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Postgres only keeps microseconds, so the times are compared at that precision
+func copyKey(t time.Time, s string) string {
+	return fmt.Sprintf("%d|%s", t.UnixMicro(), s)
+}
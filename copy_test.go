@@ -0,0 +1,135 @@
+package ss13_se
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Remembers the size of each history batch
+type batchStorage struct {
+	Storage
+	batches []int
+}
+
+func (s *batchStorage) SaveServerHistory(ctx context.Context, points []ServerPoint) error {
+	s.batches = append(s.batches, len(points))
+	return s.Storage.SaveServerHistory(ctx, points)
+}
+
+func TestCopyStorage(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	src := NewStorageMemory()
+	if err := src.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	servers := testServers()
+	for i := range servers {
+		servers[i].Time = now
+	}
+	if err := src.SaveServers(ctx, servers); err != nil {
+		t.Fatal(err)
+	}
+	// More than a batch for a, which must be split up
+	var points []ServerPoint
+	for i := 0; i < copyBatchSize+3; i++ {
+		points = append(points, ServerPoint{Time: now.Add(-time.Duration(i) * time.Minute), ServerID: "a", Players: i % 40})
+	}
+	points = append(points,
+		ServerPoint{Time: now, ServerID: "b", Players: 7},
+		ServerPoint{Time: now.Add(-time.Hour), ServerID: "b", Players: 3},
+	)
+	if err := src.SaveServerHistory(ctx, points); err != nil {
+		t.Fatal(err)
+	}
+	events := []ServerEvent{
+		{ServerID: "a", Kind: EventOnline, Time: now.Add(-48 * time.Hour)},
+		{ServerID: "a", Kind: EventOffline, Time: now.Add(-24 * time.Hour)},
+		{ServerID: "a", Kind: EventOnline, Time: now.Add(-time.Hour)},
+		{ServerID: "c", Kind: EventOffline, Time: now.Add(-time.Hour)},
+	}
+	if err := src.SaveServerEvents(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []time.Duration{2 * time.Hour, time.Hour, 0} {
+		if err := src.SaveServerCount(ctx, ServerCount{Time: now.Add(-d), Servers: 3}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta := map[string]string{
+		storageMetaDownsampled: now.AddDate(0, 0, -30).UTC().Format(time.RFC3339Nano),
+		metaDigestWeek:         startOfWeek(now).Format(time.RFC3339),
+	}
+	for k, v := range meta {
+		if err := src.SaveMeta(ctx, k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := &batchStorage{Storage: newTestSqlite(t)}
+	for run := 1; run <= 2; run++ {
+		dst.batches = nil
+		if err := CopyStorage(ctx, src, dst); err != nil {
+			t.Fatalf("copy %d: %s", run, err)
+		}
+		for _, id := range []string{"a", "b", "c"} {
+			want, err := src.GetServerHistoryRange(ctx, id, time.Time{}, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := dst.GetServerHistoryRange(ctx, id, time.Time{}, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Errorf("copy %d: got %d points for %s, want %d", run, len(got), id, len(want))
+				continue
+			}
+			for i := range got {
+				if !got[i].Time.Equal(want[i].Time) || got[i].Players != want[i].Players {
+					t.Errorf("copy %d: got point %+v for %s, want %+v", run, got[i], id, want[i])
+					break
+				}
+			}
+
+			wantEvents, err := src.GetServerEventsSince(ctx, id, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotEvents, err := dst.GetServerEventsSince(ctx, id, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(gotEvents) != len(wantEvents) {
+				t.Errorf("copy %d: got %d events for %s, want %d", run, len(gotEvents), id, len(wantEvents))
+			}
+		}
+
+		counts, err := dst.GetServerCounts(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(counts) != 3 {
+			t.Errorf("copy %d: got %d server counts, want 3", run, len(counts))
+		}
+		for k, v := range meta {
+			if got, err := dst.GetMeta(ctx, k); err != nil || got != v {
+				t.Errorf("copy %d: got meta %s %q (%v), want %q", run, k, got, err, v)
+			}
+		}
+
+		// The batches of a, and then b
+		if len(dst.batches) != 3 || dst.batches[0] != copyBatchSize || dst.batches[1] != 3 || dst.batches[2] != 2 {
+			t.Errorf("copy %d: got history batches %v, want %d, 3 and 2", run, dst.batches, copyBatchSize)
+		}
+	}
+
+	copied, err := dst.GetServers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copied) != len(servers) {
+		t.Errorf("got %d servers, want %d", len(copied), len(servers))
+	}
+}
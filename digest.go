@@ -0,0 +1,224 @@
+package ss13_se
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DigestSink delivers the weekly digests, like by email or a webhook. The text
+// is the digest rendered with the digest template, while d has the raw numbers
+// for any sinks that wants to format them on their own.
+type DigestSink interface {
+	SendDigest(ctx context.Context, d Digest, text string) error
+}
+
+// Plain text, as it's meant for emails and the logs
+var digestTmpl = template.Must(template.ParseFS(embeddedAssets, "templates/digest.txt"))
+
+// Summary of a server's players during a week, compared to the week before
+type Digest struct {
+	ServerID string     `json:"serverID"`
+	Title    string     `json:"title"`
+	From     time.Time  `json:"from"`
+	To       time.Time  `json:"to"`
+	Week     DigestWeek `json:"week"`
+	LastWeek DigestWeek `json:"lastWeek"`
+}
+
+// The numbers for one week of a Digest. It's all zero if there was no
+// history in the week.
+type DigestWeek struct {
+	Peak    ServerPoint `json:"peak"`
+	Average float64     `json:"average"`
+	// The day with the highest average, at midnight in the local timezone
+	BestDay        time.Time `json:"bestDay"`
+	BestDayAverage float64   `json:"bestDayAverage"`
+	Samples        int       `json:"samples"`
+}
+
+// Returns how many percent the average changed since the last week, or false
+// if there wasn't any players to compare with
+func (d Digest) AverageChange() (float64, bool) {
+	if d.LastWeek.Average <= 0 {
+		return 0, false
+	}
+	return (d.Week.Average - d.LastWeek.Average) / d.LastWeek.Average * 100, true
+}
+
+// Like AverageChange, but as text for the digest template
+func (d Digest) AverageChangeText() string {
+	change, ok := d.AverageChange()
+	if !ok {
+		return "no players the week before to compare with"
+	}
+	return fmt.Sprintf("%+.0f%% compared to the week before", change)
+}
+
+// Returns the difference between this and the last week's peaks
+func (d Digest) PeakChange() int {
+	return d.Week.Peak.Players - d.LastWeek.Peak.Players
+}
+
+// Renders the digest with the digest template
+func (d Digest) Render(w io.Writer) error {
+	return digestTmpl.Execute(w, d)
+}
+
+// BuildWeeklyDigest summarizes the players of a server during the last 7 days,
+// compared to the 7 days before that
+func (a *App) BuildWeeklyDigest(ctx context.Context, serverID string) (Digest, error) {
+	return a.buildDigest(ctx, serverID, time.Now())
+}
+
+// Builds the digest for the week ending at to
+func (a *App) buildDigest(ctx context.Context, id string, to time.Time) (Digest, error) {
+	server, err := a.store.GetServer(ctx, id)
+	if err != nil {
+		return Digest{}, err
+	}
+	from := to.AddDate(0, 0, -7)
+	points, err := a.store.GetServerHistoryRange(ctx, id, from.AddDate(0, 0, -7), to)
+	if err != nil {
+		return Digest{}, err
+	}
+
+	var week, lastWeek []ServerPoint
+	for _, p := range points {
+		if p.Time.After(from) {
+			week = append(week, p)
+		} else {
+			lastWeek = append(lastWeek, p)
+		}
+	}
+	return Digest{
+		ServerID: id,
+		Title:    server.Title,
+		From:     from,
+		To:       to,
+		Week:     summarizeWeek(week, to.Location()),
+		LastWeek: summarizeWeek(lastWeek, to.Location()),
+	}, nil
+}
+
+func summarizeWeek(points []ServerPoint, loc *time.Location) DigestWeek {
+	var w DigestWeek
+	if len(points) < 1 {
+		return w
+	}
+	w.Peak, _ = PeakOf(points)
+	w.Samples = len(points)
+
+	total := 0
+	sums := make(map[time.Time]int)
+	counts := make(map[time.Time]int)
+	for _, p := range points {
+		total += p.Players
+		t := p.Time.In(loc)
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		sums[day] += p.Players
+		counts[day]++
+	}
+	w.Average = float64(total) / float64(len(points))
+	for day, sum := range sums {
+		avg := float64(sum) / float64(counts[day])
+		// The earliest day wins the ties, so it's always the same
+		if avg > w.BestDayAverage || (avg == w.BestDayAverage && day.Before(w.BestDay)) {
+			w.BestDay = day
+			w.BestDayAverage = avg
+		}
+	}
+	return w
+}
+
+// Max time for building and sending all the digests of a week
+const digestTimeout = 30 * time.Second
+
+// Storage.GetMeta key for the last week the digests were sent, as the RFC3339
+// time of its monday
+const metaDigestWeek = "digest_week"
+
+// Sends the digests for the Conf.DigestServerIDs, once the updater runs in a
+// new week (starting on monday). The sent week is kept in the storage, so a
+// restart neither sends them again nor skips a week. The very first run only
+// remembers the current week, as there's nothing to summarize yet.
+func (a *App) runDigests(ctx context.Context, now time.Time) {
+	if len(a.conf.DigestServerIDs) < 1 {
+		return
+	}
+	week := startOfWeek(now)
+	// Saves a trip to the storage on every scrape
+	if !a.lastDigest.IsZero() && !week.After(a.lastDigest) {
+		return
+	}
+
+	last, err := a.getDigestWeek(ctx)
+	if err != nil && err != ErrNotFound {
+		a.log.Error("Error loading the last digest week", "err", err)
+		return
+	}
+	first := err == ErrNotFound
+	if !first && !week.After(last) {
+		a.lastDigest = last
+		return
+	}
+	// Saved before sending, as it's better to miss a week than spamming the
+	// same digests on every scrape if the storage is broken
+	if err := a.store.SaveMeta(ctx, metaDigestWeek, week.Format(time.RFC3339)); err != nil {
+		a.log.Error("Error saving the digest week", "err", err)
+		return
+	}
+	a.lastDigest = week
+	if first {
+		return
+	}
+	// Sent in the background, to not hold up the updater. It's not cancelled
+	// with the updater either, as the week has been saved already and the
+	// digests would be lost, so Run waits for them before closing the storage.
+	a.digests.Add(1)
+	go func() {
+		defer a.digests.Done()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), digestTimeout)
+		defer cancel()
+		for _, id := range a.conf.DigestServerIDs {
+			a.sendDigest(ctx, id, week)
+		}
+	}()
+}
+
+func (a *App) getDigestWeek(ctx context.Context) (time.Time, error) {
+	value, err := a.store.GetMeta(ctx, metaDigestWeek)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (a *App) sendDigest(ctx context.Context, id string, to time.Time) {
+	d, err := a.buildDigest(ctx, id, to)
+	if err != nil {
+		a.log.Error("Error building digest", "id", id, "err", err)
+		return
+	}
+	var b strings.Builder
+	if err := d.Render(&b); err != nil {
+		a.log.Error("Error rendering digest", "id", id, "err", err)
+		return
+	}
+	if a.conf.DigestSink == nil {
+		a.log.Info("Weekly digest", "id", id, "digest", b.String())
+		return
+	}
+	if err := a.conf.DigestSink.SendDigest(ctx, d, b.String()); err != nil {
+		a.log.Error("Error sending digest", "id", id, "err", err)
+	}
+}
+
+// Returns midnight of the monday of t's week, in t's timezone
+func startOfWeek(t time.Time) time.Time {
+	days := (int(t.Weekday()) + 6) % 7 // Days since monday
+	return time.Date(t.Year(), t.Month(), t.Day()-days, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,151 @@
+package ss13_se
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testDigestSink struct {
+	sent chan Digest
+}
+
+func (s testDigestSink) SendDigest(ctx context.Context, d Digest, text string) error {
+	s.sent <- d
+	return nil
+}
+
+// Waits for the digests being sent and expects n of them
+func (s testDigestSink) expect(t *testing.T, a *App, n int) {
+	t.Helper()
+	a.digests.Wait()
+	if got := len(s.sent); got != n {
+		t.Errorf("got %d digests, want %d", got, n)
+	}
+	for len(s.sent) > 0 {
+		<-s.sent
+	}
+}
+
+func TestRunDigestsRestarts(t *testing.T) {
+	ctx := context.Background()
+	store := NewStorageMemory()
+	if err := store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sink := testDigestSink{sent: make(chan Digest, 10)}
+	newApp := func() *App {
+		a := newTestApp(t, Conf{Storage: store, DigestServerIDs: []string{"a"}, DigestSink: sink})
+		if err := updateTestServers(a, time.Now(), testServers()...); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	monday := time.Date(2024, 1, 8, 12, 0, 0, 0, time.UTC)
+
+	// The first run ever only remembers the week
+	a := newApp()
+	a.runDigests(ctx, monday)
+	sink.expect(t, a, 0)
+
+	// Restarted before the next week, which must still be sent
+	a = newApp()
+	a.runDigests(ctx, monday.AddDate(0, 0, 3))
+	sink.expect(t, a, 0)
+	a = newApp()
+	a.runDigests(ctx, monday.AddDate(0, 0, 7))
+	sink.expect(t, a, 1)
+	a.runDigests(ctx, monday.AddDate(0, 0, 8))
+	sink.expect(t, a, 0)
+
+	// And not sent again after a restart in the same week
+	a = newApp()
+	a.runDigests(ctx, monday.AddDate(0, 0, 9))
+	sink.expect(t, a, 0)
+
+	// Even if it was down for a few weeks
+	a = newApp()
+	a.runDigests(ctx, monday.AddDate(0, 0, 28))
+	sink.expect(t, a, 1)
+
+	week, err := store.GetMeta(ctx, metaDigestWeek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := monday.AddDate(0, 0, 28).Add(-12 * time.Hour).Format(time.RFC3339); week != want {
+		t.Errorf("got the saved week %q, want %q", week, want)
+	}
+}
+
+type closedStorage struct {
+	Storage
+	closed atomic.Bool
+}
+
+func (s *closedStorage) Close() error {
+	s.closed.Store(true)
+	return s.Storage.Close()
+}
+
+// Takes its time, checking that the storage is still open afterwards
+type slowDigestSink struct {
+	store   *closedStorage
+	started chan struct{}
+	done    chan bool
+}
+
+func (s slowDigestSink) SendDigest(ctx context.Context, d Digest, text string) error {
+	close(s.started)
+	select {
+	case <-ctx.Done():
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.done <- ctx.Err() == nil && !s.store.closed.Load()
+	return nil
+}
+
+func TestRunWaitsForDigests(t *testing.T) {
+	client, _ := testHubClient(t, "testdata/hub.html")
+	store := &closedStorage{Storage: NewStorageMemory()}
+	sink := slowDigestSink{store: store, started: make(chan struct{}), done: make(chan bool, 1)}
+	a := newTestApp(t, Conf{
+		Storage:         store,
+		DisableWeb:      true,
+		HTTPClient:      client,
+		DigestServerIDs: []string{makeID("Alpha Station", "byond://alpha.example.com:1337")},
+		DigestSink:      sink,
+	})
+	// The last week was sent before, so the first update sends this week's
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	lastWeek := startOfWeek(time.Now()).AddDate(0, 0, -7)
+	if err := store.SaveMeta(ctx, metaDigestWeek, lastWeek.Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+	select {
+	case <-sink.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no digest was sent")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ok := <-sink.done:
+		if !ok {
+			t.Error("the digest was cancelled, or the storage closed, before it was sent")
+		}
+	default:
+		t.Error("Run returned before the digest was sent")
+	}
+}
@@ -0,0 +1,43 @@
+package ss13_se
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Minimal page with the daily chart of a server, for showing in iframes on
+// other sites. It only takes the theme from the query, as the cookie wouldn't
+// be sent by most browsers anyway.
+func (a *App) pageEmbed(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	id := vars["id"]
+	server, err := a.store.GetServer(r.Context(), id)
+	if err == ErrNotFound {
+		return HttpError{
+			Status: 404,
+			Err:    fmt.Errorf("server not found"),
+		}
+	} else if err != nil {
+		return err
+	}
+
+	ancestors := "*"
+	if len(a.conf.EmbedAncestors) > 0 {
+		ancestors = strings.Join(a.conf.EmbedAncestors, " ")
+	}
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+ancestors)
+	if a.cachedETag(w, r, server.Time, server.Players) {
+		return nil
+	}
+
+	if a.isHubEntry(server) {
+		server.Title = "Global stats"
+	}
+	theme := parseTheme(r.URL.Query().Get("theme"))
+	return a.renderTemplate(w, "embed", map[string]interface{}{
+		"Server":    server,
+		"ChartArgs": chartArgs(r, theme),
+		"Theme":     theme,
+		"Base":      a.baseURL(r),
+	})
+}
@@ -0,0 +1,118 @@
+package ss13_se
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	favoritesCookie = "favorites"
+	// Keeps the cookie well below the browsers' size limits
+	maxFavorites = 50
+)
+
+var reServerID = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// Returns the server IDs saved in the favorites cookie, skipping any invalid ones
+func readFavorites(r *http.Request) []string {
+	c, err := r.Cookie(favoritesCookie)
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	for _, id := range strings.Split(c.Value, ".") {
+		if reServerID.MatchString(id) && len(ids) < maxFavorites {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func writeFavorites(w http.ResponseWriter, r *http.Request, ids []string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     favoritesCookie,
+		Value:    strings.Join(ids, "."),
+		Path:     basePath(r) + "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func isFavorite(r *http.Request, id string) bool {
+	for _, fav := range readFavorites(r) {
+		if fav == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds or removes the server from the favorites and then sends the visitor
+// back to the server's page
+func (a *App) pageToggleFavorite(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	if r.Method != http.MethodPost {
+		return HttpError{
+			Status: http.StatusMethodNotAllowed,
+			Err:    fmt.Errorf("must be a POST request"),
+		}
+	}
+	id := vars["id"]
+	if _, err := a.store.GetServer(r.Context(), id); err == ErrNotFound {
+		return HttpError{
+			Status: 404,
+			Err:    fmt.Errorf("server not found"),
+		}
+	} else if err != nil {
+		return err
+	}
+
+	var ids []string
+	found := false
+	for _, fav := range readFavorites(r) {
+		if fav == id {
+			found = true
+			continue
+		}
+		ids = append(ids, fav)
+	}
+	if !found {
+		if len(ids) >= maxFavorites {
+			return HttpError{
+				Status: http.StatusBadRequest,
+				Err:    fmt.Errorf("too many favorites, max is %d", maxFavorites),
+			}
+		}
+		ids = append(ids, id)
+	}
+	writeFavorites(w, r, ids)
+	http.Redirect(w, r, a.conf.BasePath+"/server/"+id, http.StatusSeeOther)
+	return nil
+}
+
+func (a *App) pageFavorites(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	var servers []ServerEntry
+	for _, id := range readFavorites(r) {
+		s, err := a.store.GetServer(r.Context(), id)
+		if err == ErrNotFound {
+			// It's been removed since it was added
+			continue
+		} else if err != nil {
+			return err
+		}
+		servers = append(servers, s)
+	}
+	servers = a.removeBlocked(a.removeHubEntry(servers))
+	if err := sortServers(servers, ""); err != nil {
+		return err
+	}
+
+	return a.renderTemplate(w, "favorites", map[string]interface{}{
+		"Servers": servers,
+		"Theme":   readTheme(w, r),
+		"Hub":     a.getHub(),
+	})
+}
@@ -0,0 +1,91 @@
+package ss13_se
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Max number of new servers shown in the feed
+const feedSize = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+// Returns the scheme and host the request was made to, with the BasePath,
+// like "https://ss13.se" or "https://example.com/ss13"
+func (a *App) baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + a.conf.BasePath
+}
+
+// Atom feed of the most recently found servers
+func (a *App) pageFeed(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	// Fetching one extra, in case the hub entry is included
+	servers, err := a.store.GetNewServers(r.Context(), feedSize+1)
+	if err != nil {
+		return err
+	}
+	servers = a.removeBlocked(a.removeHubEntry(servers))
+	if len(servers) > feedSize {
+		servers = servers[:feedSize]
+	}
+
+	base := a.baseURL(r)
+	feed := atomFeed{
+		ID:    base + "/feed.xml",
+		Title: "New servers | ss13.se",
+		Link: []atomLink{
+			{Href: base + "/feed.xml", Rel: "self"},
+			{Href: base + "/"},
+		},
+		Updated: time.Time{}.Format(time.RFC3339),
+	}
+	for i, s := range servers {
+		if i == 0 {
+			feed.Updated = s.FirstSeenAt().Format(time.RFC3339)
+		}
+		summary := "First seen at " + s.FirstSeenAt().Format("2006-01-02 15:04 MST") + "."
+		if s.SiteURL != "" {
+			summary += " Website: " + s.SiteURL
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      base + "/server/" + s.ID,
+			Title:   s.Title,
+			Updated: s.FirstSeenAt().Format(time.RFC3339),
+			Link:    atomLink{Href: base + "/server/" + s.ID},
+			Summary: summary,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	if _, err := fmt.Fprint(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	return enc.Encode(feed)
+}
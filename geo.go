@@ -0,0 +1,128 @@
+package ss13_se
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Max time spent looking up the country for a single server
+const geoLookupTimeout = 5 * time.Second
+
+// How long a host's country is cached. The failed lookups are retried sooner,
+// as it's most likely a temporary DNS problem.
+const (
+	geoCacheTTL   = 24 * time.Hour
+	geoFailureTTL = 1 * time.Hour
+)
+
+// GeoResolver looks up which country an IP is located in, using a GeoIP
+// database or similar. It should return an ISO 3166-1 alpha-2 code (like "SE"),
+// or an empty string if it's unknown.
+type GeoResolver interface {
+	Country(ip net.IP) (string, error)
+}
+
+type geoEntry struct {
+	country string
+	expires time.Time
+}
+
+// Sets the Country for all servers, using the Conf.GeoResolver.
+// Any failures are only logged, leaving the Country empty.
+func (a *App) resolveCountries(ctx context.Context, servers []ServerEntry) {
+	if a.conf.GeoResolver == nil {
+		return
+	}
+	now := time.Now()
+	a.pruneGeoCache(now)
+	runWorkers(a.conf.ScrapeConcurrency, len(servers), func(i int) {
+		servers[i].Country = a.cachedCountry(ctx, servers[i].GameURL, now)
+	})
+}
+
+// Removes the expired hosts, or the servers that has gone away would be kept
+// in the cache forever
+func (a *App) pruneGeoCache(now time.Time) {
+	a.geoLock.Lock()
+	defer a.geoLock.Unlock()
+	for host, e := range a.geoCache {
+		if !now.Before(e.expires) {
+			delete(a.geoCache, host)
+		}
+	}
+}
+
+func (a *App) cachedCountry(ctx context.Context, gameURL string, now time.Time) string {
+	host := parseHost(gameURL)
+	if host == "" {
+		return ""
+	}
+	a.geoLock.Lock()
+	e, found := a.geoCache[host]
+	a.geoLock.Unlock()
+	if found && now.Before(e.expires) {
+		return e.country
+	}
+
+	country, err := a.resolveCountry(ctx, host)
+	ttl := geoCacheTTL
+	if err != nil {
+		a.log.Debug("Could not resolve server country", "host", host, "err", err)
+		ttl = geoFailureTTL
+	}
+	a.geoLock.Lock()
+	a.geoCache[host] = geoEntry{country: country, expires: now.Add(ttl)}
+	a.geoLock.Unlock()
+	return country
+}
+
+func (a *App) resolveCountry(ctx context.Context, host string) (country string, err error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ctx, cancel := context.WithTimeout(ctx, geoLookupTimeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", err
+		}
+		if len(addrs) < 1 {
+			return "", fmt.Errorf("no addresses found")
+		}
+		ip = addrs[0].IP
+	}
+
+	// A buggy resolver would otherwise take down the whole app, as it's run
+	// in the worker goroutines
+	defer func() {
+		if r := recover(); r != nil {
+			a.log.Error("Recovered from panic in GeoResolver", "host", host, "ip", ip, "panic", r, "stack", string(debug.Stack()))
+			country, err = "", fmt.Errorf("panic: %v", r)
+		}
+	}()
+	country, err = a.conf.GeoResolver.Country(ip)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(country), nil
+}
+
+// Returns the host part of a game url, like "byond://example.com:1234"
+func parseHost(gameURL string) string {
+	gameURL = strings.TrimSpace(gameURL)
+	if gameURL == "" {
+		return ""
+	}
+	if !strings.Contains(gameURL, "://") {
+		gameURL = "byond://" + gameURL
+	}
+	u, err := url.Parse(gameURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,79 @@
+package ss13_se
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Counts the lookups per IP, failing or panicking for some of them
+type testResolver struct {
+	lock    sync.Mutex
+	lookups map[string]int
+}
+
+func (r *testResolver) Country(ip net.IP) (string, error) {
+	r.lock.Lock()
+	r.lookups[ip.String()]++
+	r.lock.Unlock()
+	switch ip.String() {
+	case "10.0.0.2":
+		return "", errors.New("not in the database")
+	case "10.0.0.3":
+		var m map[string]string
+		m["boom"] = "boom"
+	}
+	return "se", nil
+}
+
+func TestResolveCountries(t *testing.T) {
+	resolver := &testResolver{lookups: make(map[string]int)}
+	a := newTestApp(t, Conf{GeoResolver: resolver})
+	newServers := func() []ServerEntry {
+		return []ServerEntry{
+			{GameURL: "byond://10.0.0.1:1337"},
+			{GameURL: "byond://10.0.0.1:2000"}, // Same host
+			{GameURL: "byond://10.0.0.2:1337"},
+			{GameURL: "byond://10.0.0.3:1337"},
+			{GameURL: ""},
+		}
+	}
+
+	servers := newServers()
+	a.resolveCountries(context.Background(), servers)
+	want := []string{"SE", "SE", "", "", ""}
+	for i, s := range servers {
+		if s.Country != want[i] {
+			t.Errorf("got country %q for %q, want %q", s.Country, s.GameURL, want[i])
+		}
+	}
+
+	// All of them are cached, even the failed ones
+	servers = newServers()
+	a.resolveCountries(context.Background(), servers)
+	for ip, n := range resolver.lookups {
+		if n != 1 {
+			t.Errorf("got %d lookups for %s, want 1", n, ip)
+		}
+	}
+	if servers[0].Country != "SE" {
+		t.Errorf("got country %q from the cache, want SE", servers[0].Country)
+	}
+
+	// Until they expire, the failures first
+	a.pruneGeoCache(time.Now().Add(geoFailureTTL))
+	if len(a.geoCache) != 1 {
+		t.Errorf("got %d cached hosts after the failures expired, want 1", len(a.geoCache))
+	}
+	a.pruneGeoCache(time.Now().Add(geoCacheTTL))
+	if len(a.geoCache) != 0 {
+		t.Errorf("got %d cached hosts after all expired, want 0", len(a.geoCache))
+	}
+	a.resolveCountries(context.Background(), newServers())
+	if n := resolver.lookups["10.0.0.1"]; n != 2 {
+		t.Errorf("got %d lookups after the cache expired, want 2", n)
+	}
+}
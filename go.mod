@@ -1,19 +1,36 @@
 module github.com/lmas/ss13_se
 
-go 1.12
+go 1.21
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.0
-	github.com/blend/go-sdk v2.0.0+incompatible // indirect
-	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
 	github.com/gorilla/mux v1.7.1
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/kr/pretty v0.1.0
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.10.0
+	github.com/prometheus/client_golang v1.11.1
 	github.com/sajari/regression v1.0.0
 	github.com/wcharczuk/go-chart v2.0.1+incompatible
+	golang.org/x/crypto v0.14.0
+	golang.org/x/text v0.13.0
+)
+
+require (
+	github.com/andybalholm/cascadia v1.0.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/blend/go-sdk v2.0.0+incompatible // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
 	golang.org/x/image v0.0.0-20190507092727-e4e5bf290fec // indirect
-	golang.org/x/text v0.3.2
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 	gonum.org/v1/gonum v0.0.0-20190509213835-50179cd3f3f7 // indirect
 	google.golang.org/appengine v1.5.0 // indirect
+	google.golang.org/protobuf v1.26.0-rc.1 // indirect
 )
@@ -1,10 +1,22 @@
 package ss13_se
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
 )
 
 type HttpError struct {
@@ -18,30 +30,280 @@ func (s HttpError) Error() string {
 
 type handlerVars map[string]string
 
+// Can be used instead of the real ID of the internal hub entry, in the urls
+const hubAlias = "hub"
+
+type basePathKey struct{}
+
+// Remembers the BasePath in the request's context, for the handler wrapper's
+// error page (which doesn't know about the App)
+func (a *App) basePathHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), basePathKey{}, a.conf.BasePath)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Returns the BasePath for the request, or "" for the root
+func basePath(r *http.Request) string {
+	base, _ := r.Context().Value(basePathKey{}).(string)
+	return base
+}
+
+// Resolves the hub alias in the route vars, for all the handlers
+func (a *App) hubAliasHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if id, ok := vars["id"]; ok {
+			vars["id"] = a.resolveServerID(id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the real ID for the hub alias, or id as it is
+func (a *App) resolveServerID(id string) string {
+	if id == hubAlias {
+		return a.hubID()
+	}
+	return id
+}
+
 type handler func(http.ResponseWriter, *http.Request, handlerVars) error
 
 func (h handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	//start := time.Now()
+	// Keeps the errors in the same format as the page, see wantsJSON
+	if wantsJSON(req) {
+		apiHandler(h).ServeHTTP(rw, req)
+		return
+	}
 	err := h(rw, req, mux.Vars(req))
-	//dur := time.Since(start)
+	if err == nil {
+		return
+	}
+	status, msg := errorStatus(err)
+	if !acceptsHTML(req) {
+		// Keeps the plain errors for curl and the like
+		http.Error(rw, fmt.Sprintf("%d %s", status, msg), status)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	errorTmpl.Execute(rw, map[string]interface{}{ // TODO: handle error?
+		"Status":     status,
+		"StatusText": http.StatusText(status),
+		"Message":    msg,
+		"Theme":      readTheme(rw, req),
+		"Base":       basePath(req),
+	})
+}
+
+// Returns the status and the message to send for a handler's error. Only the
+// HttpErrors have their messages shown, as the others might leak internal
+// details, and errors from an unreachable database gets a 503 instead of a 500.
+func errorStatus(err error) (int, string) {
+	var e HttpError
+	if errors.As(err, &e) {
+		return e.Status, e.Err.Error()
+	}
+	if storageDown(err) {
+		return http.StatusServiceUnavailable, "the database is unavailable, try again later"
+	}
+	return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+}
+
+// Returns true if the error is from a database that can't be reached (or is
+// too busy) right now, instead of a bad query
+func storageDown(err error) bool {
+	if errors.Is(err, sql.ErrConnDone) || errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// Returns true if the client explicitly accepts HTML, like the browsers does
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// Like handler, but any errors are sent back as a JSON body instead
+type apiHandler func(http.ResponseWriter, *http.Request, handlerVars) error
+
+func (h apiHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	err := h(rw, req, mux.Vars(req))
+	if err == nil {
+		return
+	}
+
+	status, msg := errorStatus(err)
+	writeJSON(rw, status, map[string]string{"error": msg})
+}
+
+// Returns true if the client prefers JSON over HTML, by the Accept header.
+// Some of the pages can be sent as JSON too, but they're HTML by default.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+	var jsonQ, htmlQ float64
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		q := 1.0
+		for _, p := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "application/json":
+			jsonQ = math.Max(jsonQ, q)
+		case "text/html", "*/*":
+			htmlQ = math.Max(htmlQ, q)
+		}
+	}
+	return jsonQ > htmlQ
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Parses the optional "from" and "to" RFC3339 query params, defaulting to the
+// last defaultDays days
+func parseTimeRange(q url.Values, defaultDays int) (time.Time, time.Time, error) {
+	to := time.Now()
+	if s := q.Get("to"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return time.Time{}, time.Time{}, HttpError{
+				Status: http.StatusBadRequest,
+				Err:    fmt.Errorf("invalid to time, must be RFC3339"),
+			}
+		}
+		to = t
+	}
+
+	from := to.AddDate(0, 0, -defaultDays)
+	if s := q.Get("from"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return time.Time{}, time.Time{}, HttpError{
+				Status: http.StatusBadRequest,
+				Err:    fmt.Errorf("invalid from time, must be RFC3339"),
+			}
+		}
+		from = t
+	}
 
+	if from.After(to) {
+		return time.Time{}, time.Time{}, HttpError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("from time is after to time"),
+		}
+	}
+	return from, to, nil
+}
+
+// Parses an optional integer query param, returning def if it's missing
+func parseIntParam(q url.Values, key string, def int) (int, error) {
+	s := q.Get(key)
+	if s == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(s)
 	if err != nil {
-		switch e := err.(type) {
-		case HttpError:
-			http.Error(rw, e.Error(), e.Status)
-		default:
-			http.Error(rw, http.StatusText(http.StatusInternalServerError),
-				http.StatusInternalServerError)
-		}
-	}
-
-	//log.Printf("%s %s \t%s \terr: %v\n",
-	//req.RemoteAddr,
-	//req.Method,
-	//req.URL.String(),
-	//req.UserAgent(),
-	//dur,
-	//resp.Status,
-	//err,
-	//)
+		return 0, HttpError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("invalid %s, must be a number", key),
+		}
+	}
+	return i, nil
+}
+
+// Parses an optional true/false query param, like "bands=true"
+func parseBoolParam(q url.Values, key string) (bool, error) {
+	s := q.Get(key)
+	if s == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, HttpError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("invalid %s, must be true or false", key),
+		}
+	}
+	return b, nil
+}
+
+// Returns true if the optional "annotate" query param asks for the peaks to
+// be shown in a chart
+func parseAnnotate(q url.Values) (bool, error) {
+	switch q.Get("annotate") {
+	case "":
+		return false, nil
+	case "peak":
+		return true, nil
+	default:
+		return false, HttpError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("invalid annotate, must be \"peak\""),
+		}
+	}
+}
+
+// Returns the location from the optional "tz" query param (an IANA name like
+// "Europe/Stockholm"), defaulting to the local time if it's missing.
+// Invalid names falls back to UTC, so a bad link still shows a chart.
+func (a *App) parseTimezone(q url.Values) *time.Location {
+	name := q.Get("tz")
+	if name == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		a.log.Warn("Invalid timezone, using UTC", "tz", name, "err", err)
+		return time.UTC
+	}
+	return loc
+}
+
+// Sets the Last-Modified header and returns true if the client's copy isn't
+// older than modified, after sending a 304. Meant for pages that only changes
+// once per scrape, so modified is usually the time of the last scrape.
+// Does nothing if there's been no scrape yet (the zero time).
+func notModified(w http.ResponseWriter, r *http.Request, modified time.Time) bool {
+	if modified.IsZero() {
+		return false
+	}
+	// The header only has a resolution of seconds
+	modified = modified.Truncate(time.Second)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	// Makes the clients check with us each time, instead of guessing how
+	// long their copy is fresh
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
 }
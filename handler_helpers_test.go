@@ -0,0 +1,108 @@
+package ss13_se
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		msg    string
+	}{
+		{HttpError{Status: 404, Err: fmt.Errorf("server not found")}, 404, "server not found"},
+		{fmt.Errorf("wrapped: %w", HttpError{Status: 400, Err: fmt.Errorf("bad page")}), 400, "bad page"},
+		{fmt.Errorf("query: %w", sql.ErrConnDone), 503, "the database is unavailable, try again later"},
+		{driver.ErrBadConn, 503, "the database is unavailable, try again later"},
+		{context.DeadlineExceeded, 503, "the database is unavailable, try again later"},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, 503, "the database is unavailable, try again later"},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, 503, "the database is unavailable, try again later"},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, 500, "Internal Server Error"},
+		{errors.New("secret internal details"), 500, "Internal Server Error"},
+	}
+	for _, tt := range tests {
+		status, msg := errorStatus(tt.err)
+		if status != tt.status || msg != tt.msg {
+			t.Errorf("%v: got %d %q, want %d %q", tt.err, status, msg, tt.status, tt.msg)
+		}
+	}
+}
+
+// Fails all reads, like when the database is down
+type downStorage struct {
+	Storage
+}
+
+func (s downStorage) GetServer(ctx context.Context, id string) (ServerEntry, error) {
+	return ServerEntry{}, fmt.Errorf("query: %w", sql.ErrConnDone)
+}
+
+func (s downStorage) GetServers(ctx context.Context) ([]ServerEntry, error) {
+	return nil, fmt.Errorf("query: %w", sql.ErrConnDone)
+}
+
+func TestHandlerErrors(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	down := newTestApp(t, Conf{Storage: downStorage{NewStorageMemory()}})
+	html := "text/html,application/xhtml+xml,*/*;q=0.8"
+	tests := []struct {
+		app    *App
+		target string
+		accept string
+		status int
+		body   string
+	}{
+		{a, "/server/missing", html, 404, "<html"},
+		{a, "/server/missing", "application/json", 404, `{"error":"server not found"}`},
+		{a, "/server/missing", "", 404, "404 server not found"},
+		{a, "/?page=abc", html, 400, "<html"},
+		{a, "/?page=abc", "", 400, "400 "},
+		{a, "/api/servers?sort=bogus", "", 400, `{"error":`},
+		{a, "/api/servers?minPlayers=-1", html, 400, `{"error":"invalid minPlayers, can't be negative"}`},
+		{down, "/server/abc", html, 503, "<html"},
+		{down, "/server/abc", "", 503, "503 the database is unavailable"},
+		{down, "/api/servers", "", 503, `{"error":"the database is unavailable, try again later"}`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := serve(tt.app, r)
+		if w.Code != tt.status {
+			t.Errorf("GET %s (%s): got status %d, want %d", tt.target, tt.accept, w.Code, tt.status)
+		}
+		if body := w.Body.String(); !strings.Contains(body, tt.body) {
+			t.Errorf("GET %s (%s): got body %q, want it to contain %q", tt.target, tt.accept, body, tt.body)
+		}
+		if strings.HasPrefix(tt.body, "{") {
+			var v map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+				t.Errorf("GET %s (%s): got invalid JSON: %s", tt.target, tt.accept, err)
+			}
+		}
+	}
+}
+
+func TestHandlerHidesInternalErrors(t *testing.T) {
+	h := handler(func(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+		return errors.New("secret internal details")
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 500 || strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("got status %d and body %q, want a 500 without the details", w.Code, w.Body)
+	}
+}
@@ -1,63 +1,559 @@
 package ss13_se
 
 import (
+	"context"
+	"encoding/csv"
 	"fmt"
+	"io/fs"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+var reFilename = regexp.MustCompile(`[^a-z0-9]+`)
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+// Keeps the crawlers away from the charts, they're expensive to render
+const defaultRobotsTxt = `User-agent: *
+Disallow: /server/*/daily
+Disallow: /server/*/weekly
+Disallow: /server/*/monthly
+Disallow: /server/*/averagedaily
+Disallow: /server/*/averagehourly
+Disallow: /server/*/heatmap
+Disallow: /server/*/history.csv
+Disallow: /server/*/embed
+Disallow: /compare
+Disallow: /stats/history
+Disallow: /api/
+`
+
 func (a *App) pageIndex(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
-	servers, err := a.store.GetServers()
+	q := r.URL.Query()
+	page, err := parseIntParam(q, "page", 1)
 	if err != nil {
 		return err
 	}
+	perPage, err := parseIntParam(q, "perPage", defaultPerPage)
+	if err != nil {
+		return err
+	}
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > maxPerPage {
+		perPage = defaultPerPage
+	}
+	minPlayers, err := parseMinPlayers(q)
+	if err != nil {
+		return err
+	}
+
+	// The page depends on the theme cookie too, and can be sent as JSON.
+	// A stale page is always sent in full, so the warning isn't missed.
+	_, last := a.getStatus()
+	w.Header().Add("Vary", "Cookie")
+	w.Header().Add("Vary", "Accept")
+	if !a.isStale(last) && notModified(w, r, last) {
+		return nil
+	}
 
-	// Remove the internal entry used to count total players
-	index := -1
-	for i, s := range servers {
-		if s.Title == internalServerTitle {
-			index = i
-			break
+	sq := ServerQuery{
+		Sort:       q.Get("sort"),
+		Offset:     (page - 1) * perPage,
+		Limit:      perPage,
+		Country:    strings.TrimSpace(q.Get("country")),
+		Source:     strings.TrimSpace(q.Get("source")),
+		MinPlayers: minPlayers,
+		// Blocked titles are only filtered out of the search results, but
+		// they're removed from the storage on the next update anyway
+		ExcludeIDs: append([]string{a.hubID()}, a.conf.BlockedServerIDs...),
+	}
+	if err := validSort(sq.Sort); err != nil {
+		return err
+	}
+	var servers []ServerEntry
+	var total int
+	var cachedAt time.Time
+	if query := strings.TrimSpace(q.Get("q")); query != "" {
+		// The search results are small enough to be filtered here
+		servers, err = a.store.SearchServers(r.Context(), query)
+		if err == nil {
+			servers, total, err = queryServers(a.removeBlocked(servers), sq)
 		}
+	} else {
+		servers, total, cachedAt, err = a.getServersPage(r.Context(), sq)
 	}
-	if index > -1 {
-		servers = append(servers[:index], servers[index+1:]...)
+	if err != nil {
+		return err
+	}
+
+	var prevURL, nextURL string
+	if page > 1 {
+		prevURL = pageURL(a.conf.BasePath, q, page-1)
+	}
+	if page*perPage < total {
+		nextURL = pageURL(a.conf.BasePath, q, page+1)
+	}
+
+	if wantsJSON(r) {
+		if servers == nil {
+			servers = []ServerEntry{}
+		}
+		data := map[string]interface{}{
+			"servers":    servers,
+			"total":      total,
+			"page":       page,
+			"perPage":    perPage,
+			"prevURL":    prevURL,
+			"nextURL":    nextURL,
+			"lastScrape": last,
+			"stale":      a.isStale(last),
+			"trends":     a.getTrends(),
+		}
+		if !cachedAt.IsZero() {
+			data["cachedAt"] = cachedAt
+		}
+		return writeJSON(w, http.StatusOK, data)
+	}
+	return a.renderTemplate(w, "index", map[string]interface{}{
+		"Updated":    timeAgo(last, time.Now()),
+		"Stale":      a.isStale(last),
+		"CachedAt":   cachedAt.Format("2006-01-02 15:04 MST"),
+		"Cached":     !cachedAt.IsZero(),
+		"Servers":    servers,
+		"Trends":     a.getTrends(),
+		"Sort":       q.Get("sort"),
+		"Query":      q.Get("q"),
+		"Country":    q.Get("country"),
+		"Source":     q.Get("source"),
+		"Sources":    a.conf.HubSources,
+		"MinPlayers": minPlayers,
+		"PrevURL":    prevURL,
+		"NextURL":    nextURL,
+		"Theme":      readTheme(w, r),
+		"Hub":        a.getHub(),
+	})
+}
+
+// Remembers the servers from the last update, for getServersPage
+func (a *App) cacheServers(servers []ServerEntry, t time.Time) {
+	a.serversLock.Lock()
+	a.servers = append([]ServerEntry(nil), servers...)
+	a.serversLoaded = t
+	a.serversLock.Unlock()
+}
+
+// Returns a page of servers from the store, or from the servers of the last
+// update if the store fails, so the index still works during database hiccups.
+// The time of that update is returned for those, or else the zero time.
+func (a *App) getServersPage(ctx context.Context, q ServerQuery) ([]ServerEntry, int, time.Time, error) {
+	servers, total, err := a.store.GetServersPage(ctx, q)
+	if err == nil || ctx.Err() != nil {
+		return servers, total, time.Time{}, err
 	}
 
-	return a.templates["index"].Execute(w, map[string]interface{}{
+	a.serversLock.RLock()
+	defer a.serversLock.RUnlock()
+	if a.serversLoaded.IsZero() {
+		a.log.Error("Error loading servers", "err", err)
+		return nil, 0, time.Time{}, HttpError{
+			Status: http.StatusServiceUnavailable,
+			Err:    fmt.Errorf("data temporarily unavailable, please try again later"),
+		}
+	}
+	a.log.Error("Error loading servers, using the cached ones", "err", err, "loaded", a.serversLoaded)
+	// Copied, as they're sorted while filtering
+	servers, total, err = queryServers(append([]ServerEntry(nil), a.servers...), q)
+	return servers, total, a.serversLoaded, err
+}
+
+// Returns true if the last successful scrape is too old, and the data is
+// probably out of date
+func (a *App) isStale(last time.Time) bool {
+	return time.Since(last) > 2*a.conf.ScrapeTimeout
+}
+
+// Returns a rough, human readable, description of how long ago t was
+func timeAgo(t, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d/time.Minute), "minute") + " ago"
+	case d < 48*time.Hour:
+		return plural(int(d/time.Hour), "hour") + " ago"
+	}
+	return plural(int(d/(24*time.Hour)), "day") + " ago"
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// Returns the index url for another page, keeping all the other params
+func pageURL(base string, q url.Values, page int) string {
+	v := url.Values{}
+	for k, vals := range q {
+		v[k] = vals
+	}
+	v.Set("page", strconv.Itoa(page))
+	return base + "/?" + v.Encode()
+}
+
+// Sorts the servers by "players" (the most first) or "title", where a "-"
+// prefix reverses the order. Defaults to players if by is empty.
+// Equal servers are ordered by their ID, so the order is always the same.
+func sortServers(servers []ServerEntry, by string) error {
+	reverse := strings.HasPrefix(by, "-")
+	by = strings.TrimPrefix(by, "-")
+
+	var less func(a, b ServerEntry) bool
+	switch by {
+	case "", "players":
+		less = func(a, b ServerEntry) bool {
+			return a.Players > b.Players
+		}
+	case "title":
+		less = func(a, b ServerEntry) bool {
+			return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+		}
+	default:
+		return validSort(by)
+	}
+
+	sort.SliceStable(servers, func(i, j int) bool {
+		a, b := servers[i], servers[j]
+		if reverse {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		} else if less(b, a) {
+			return false
+		}
+		return a.ID < b.ID
+	})
+	return nil
+}
+
+// Returns an error if by isn't one of the sorts supported by sortServers
+func validSort(by string) error {
+	switch strings.TrimPrefix(by, "-") {
+	case "", "players", "title":
+		return nil
+	}
+	return HttpError{
+		Status: http.StatusBadRequest,
+		Err:    fmt.Errorf("invalid sort, must be one of: players, title"),
+	}
+}
+
+// Returns only the servers hosted in country (an ISO code, like "SE")
+func filterCountry(servers []ServerEntry, country string) []ServerEntry {
+	var filtered []ServerEntry
+	for _, s := range servers {
+		if strings.EqualFold(s.Country, country) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// Returns only the servers found in the byond hub source
+func filterSource(servers []ServerEntry, source string) []ServerEntry {
+	var filtered []ServerEntry
+	for _, s := range servers {
+		if strings.EqualFold(s.Source, source) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// Returns only the servers with at least min players
+func filterPlayers(servers []ServerEntry, min int) []ServerEntry {
+	if min < 1 {
+		return servers
+	}
+	var filtered []ServerEntry
+	for _, s := range servers {
+		if s.Players >= min {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// Parses the optional "minPlayers" query param, defaulting to 0 (all servers)
+func parseMinPlayers(q url.Values) (int, error) {
+	min, err := parseIntParam(q, "minPlayers", 0)
+	if err != nil {
+		return 0, err
+	}
+	if min < 0 {
+		return 0, HttpError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("invalid minPlayers, can't be negative"),
+		}
+	}
+	return min, nil
+}
+
+const (
+	defaultLeaderboardLimit = 10
+	maxLeaderboardLimit     = 100
+	// The player-hours loads all the history, so it's kept to a month
+	maxPlayerHoursDays = 30
+)
+
+// Returns the top servers, using the optional "metric" ("average", "peak" or
+// "playerhours"), "days" and "limit" query params. Defaults to the average over
+// the last week.
+func (a *App) getLeaderboard(ctx context.Context, q url.Values) ([]TopServer, TopMetric, int, error) {
+	metric := TopMetric(q.Get("metric"))
+	switch metric {
+	case "":
+		metric = TopByAverage
+	case TopByAverage, TopByPeak, TopByPlayerHours:
+	default:
+		return nil, "", 0, HttpError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("invalid metric, must be one of: average, peak, playerhours"),
+		}
+	}
+	days, err := parseIntParam(q, "days", 7)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if days < 1 || days > 365 {
+		return nil, "", 0, HttpError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("invalid days, must be between 1 and 365"),
+		}
+	}
+	limit, err := parseIntParam(q, "limit", defaultLeaderboardLimit)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if limit < 1 || limit > maxLeaderboardLimit {
+		limit = defaultLeaderboardLimit
+	}
+
+	// Fetching one extra, in case the hub entry is included
+	var servers []TopServer
+	if metric == TopByPlayerHours {
+		if days > maxPlayerHoursDays {
+			return nil, "", 0, HttpError{
+				Status: http.StatusBadRequest,
+				Err:    fmt.Errorf("invalid days, must be between 1 and %d for playerhours", maxPlayerHoursDays),
+			}
+		}
+		servers, err = a.topByPlayerHours(ctx, days, limit+1)
+	} else {
+		servers, err = a.store.GetTopServers(ctx, time.Duration(days)*24*time.Hour, metric, limit+1)
+	}
+	if err != nil {
+		return nil, "", 0, err
+	}
+	top := []TopServer{}
+	for _, s := range servers {
+		if s.ID != a.hubID() && len(top) < limit {
+			top = append(top, s)
+		}
+	}
+	return top, metric, days, nil
+}
+
+// Ranks the servers by their player-hours per day, during the last days
+func (a *App) topByPlayerHours(ctx context.Context, days, limit int) ([]TopServer, error) {
+	points, err := a.store.GetServerHistory(ctx, days)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := a.store.GetServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make(map[string][]ServerPoint)
+	for _, p := range points {
+		history[p.ServerID] = append(history[p.ServerID], p)
+	}
+	var top []TopServer
+	gap := a.chartGap(0)
+	for _, s := range stored {
+		if h, ok := history[s.ID]; ok {
+			top = append(top, TopServer{
+				ID:    s.ID,
+				Title: s.Title,
+				Value: PlayerHours(h, gap) / float64(days),
+			})
+		}
+	}
+	sort.SliceStable(top, func(i, j int) bool {
+		if top[i].Value != top[j].Value {
+			return top[i].Value > top[j].Value
+		}
+		return top[i].ID < top[j].ID
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	return top, nil
+}
+
+func (a *App) pageLeaderboard(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	servers, metric, days, err := a.getLeaderboard(r.Context(), r.URL.Query())
+	if err != nil {
+		return err
+	}
+	return a.renderTemplate(w, "leaderboard", map[string]interface{}{
 		"Servers": servers,
-		"Hub":     a.hub,
+		"Metric":  metric,
+		"Days":    days,
+		"Theme":   readTheme(w, r),
+		"Hub":     a.getHub(),
 	})
 }
 
 func (a *App) pageStyle(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	b, err := fs.ReadFile(a.assets, "static/style.css")
+	if err != nil {
+		return err
+	}
 	w.Header().Set("Content-Type", "text/css")
-	return a.templates["style"].Execute(w, nil)
+	_, err = w.Write(b)
+	return err
+}
+
+func (a *App) pageFavicon(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	b, err := fs.ReadFile(a.assets, "static/favicon.ico")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "image/x-icon")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, err = w.Write(b)
+	return err
+}
+
+func (a *App) pageRobots(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := fmt.Fprint(w, a.conf.RobotsTxt)
+	return err
 }
 
 func (a *App) pageServer(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
 	id := vars["id"]
-	server, err := a.store.GetServer(id)
-	if err != nil {
-		// TODO: handle and log the error properly
+	server, err := a.store.GetServer(r.Context(), id)
+	if err == ErrNotFound || (err == nil && a.isBlocked(server)) {
 		return HttpError{
 			Status: 404,
 			Err:    fmt.Errorf("server not found"),
 		}
+	} else if err != nil {
+		a.log.Error("Error loading server", "id", id, "err", err)
+		return err
 	}
 
-	if server.Title == internalServerTitle {
+	isHub := a.isHubEntry(server)
+	if isHub {
 		server.Title = "Global stats"
 	}
 
-	return a.templates["server"].Execute(w, map[string]interface{}{
-		"Server": server,
-		"Hub":    a.hub,
+	events, err := a.store.GetServerEvents(r.Context(), id, 10)
+	if err != nil {
+		return err
+	}
+	var uptime Uptime
+	if !isHub {
+		if uptime, err = a.getUptime(r, server, events); err != nil {
+			return err
+		}
+	}
+	week, err := a.store.GetSingleServerHistory(r.Context(), id, 7)
+	if err != nil {
+		return err
+	}
+
+	// Per day, as an average over the last week
+	playerHours := PlayerHours(week, a.chartGap(0)) / 7
+
+	w.Header().Add("Vary", "Accept")
+	if wantsJSON(r) {
+		if events == nil {
+			events = []ServerEvent{}
+		}
+		data := map[string]interface{}{
+			"server":      server,
+			"events":      events,
+			"playerHours": playerHours,
+		}
+		if !isHub {
+			data["uptime"] = map[string]interface{}{
+				"online":         uptime.Online,
+				"ageSeconds":     uptime.Age.Seconds(),
+				"currentSeconds": uptime.Current.Seconds(),
+				"percent":        uptime.Percent,
+				"days":           uptimeDays,
+			}
+		}
+		return writeJSON(w, http.StatusOK, data)
+	}
+	theme := readTheme(w, r)
+	return a.renderTemplate(w, "server", map[string]interface{}{
+		"Server":      server,
+		"Events":      events,
+		"Uptime":      uptime,
+		"UptimeDays":  uptimeDays,
+		"PlayerHours": playerHours,
+		"ChartArgs":   chartArgs(r, theme),
+		"Base":        a.baseURL(r),
+		"IsHub":       isHub,
+		"Favorite":    isFavorite(r, id),
+		"Theme":       theme,
+		"Hub":         a.getHub(),
 	})
 }
 
+// Returns the query params passed on from a page to its charts, including the
+// leading "?" (or an empty string if there's none)
+func chartArgs(r *http.Request, theme Theme) string {
+	args := url.Values{}
+	// The timezone and any chartOptions
+	for _, name := range []string{"tz", "w", "h", "line", "bg"} {
+		if v := r.URL.Query().Get(name); v != "" {
+			args.Set(name, v)
+		}
+	}
+	if theme != "" {
+		args.Set("theme", string(theme))
+	}
+	if len(args) < 1 {
+		return ""
+	}
+	return "?" + args.Encode()
+}
+
 func (a *App) pageDailyChart(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
 	id := vars["id"]
-	points, err := a.store.GetSingleServerHistory(id, 1)
+	points, err := a.store.GetSingleServerHistory(r.Context(), id, 1)
 	if err != nil {
 		return err
 	}
@@ -67,14 +563,30 @@ func (a *App) pageDailyChart(w http.ResponseWriter, r *http.Request, vars handle
 			Err:    fmt.Errorf("server not found"),
 		}
 	}
+	if a.cachedChart(w, r, points) {
+		return nil
+	}
+	smooth, err := parseIntParam(r.URL.Query(), "smooth", 0)
+	if err != nil {
+		return err
+	}
+	annotate, err := parseAnnotate(r.URL.Query())
+	if err != nil {
+		return err
+	}
 
-	c := makeHistoryChart(points, true)
-	return a.renderChart(w, c)
+	loc := a.parseTimezone(r.URL.Query())
+	points, bucket := limitPoints(points, maxChartPoints)
+	c := makeHistoryChart(MovingAverage(points, smooth), true, a.chartGap(bucket), loc)
+	if annotate {
+		annotatePeaks(&c, loc)
+	}
+	return a.renderChart(w, r, c)
 }
 
 func (a *App) pageWeeklyChart(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
 	id := vars["id"]
-	points, err := a.store.GetSingleServerHistory(id, 6)
+	points, err := a.store.GetSingleServerHistory(r.Context(), id, 6)
 	if err != nil {
 		return err
 	}
@@ -84,14 +596,156 @@ func (a *App) pageWeeklyChart(w http.ResponseWriter, r *http.Request, vars handl
 			Err:    fmt.Errorf("server not found"),
 		}
 	}
+	if a.cachedChart(w, r, points) {
+		return nil
+	}
+	smooth, err := parseIntParam(r.URL.Query(), "smooth", 0)
+	if err != nil {
+		return err
+	}
+	annotate, err := parseAnnotate(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	loc := a.parseTimezone(r.URL.Query())
+	points, bucket := limitPoints(points, maxChartPoints)
+	c := makeHistoryChart(MovingAverage(points, smooth), false, a.chartGap(bucket), loc)
+	if annotate {
+		annotatePeaks(&c, loc)
+	}
+	return a.renderChart(w, r, c)
+}
+
+func (a *App) pageMonthlyChart(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	id := vars["id"]
+	points, err := a.store.GetSingleServerHistory(r.Context(), id, 30)
+	if err != nil {
+		return err
+	}
+	if len(points) < 1 {
+		return HttpError{
+			Status: 404,
+			Err:    fmt.Errorf("server not found"),
+		}
+	}
+	if a.cachedChart(w, r, points) {
+		return nil
+	}
+	annotate, err := parseAnnotate(r.URL.Query())
+	if err != nil {
+		return err
+	}
 
-	c := makeHistoryChart(points, false)
-	return a.renderChart(w, c)
+	loc := a.parseTimezone(r.URL.Query())
+	points, bucket := limitPoints(averageHistory(points, time.Hour), maxChartPoints)
+	if bucket < time.Hour {
+		bucket = time.Hour
+	}
+	c := makeHistoryChart(points, false, a.chartGap(bucket), loc)
+	if annotate {
+		annotatePeaks(&c, loc)
+	}
+	return a.renderChart(w, r, c)
+}
+
+// Shows the history of two servers, a and b, on the same chart.
+// The range param can be "daily", "weekly" (the default) or "monthly", like
+// the single server charts.
+func (a *App) pageCompareChart(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	q := r.URL.Query()
+	ids := []string{q.Get("a"), q.Get("b")}
+	if ids[0] == "" || ids[1] == "" {
+		return HttpError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("missing server ids, must set both a and b"),
+		}
+	}
+
+	var days int
+	var average bool
+	switch q.Get("range") {
+	case "daily":
+		days = 1
+	case "", "weekly":
+		days = 6
+	case "monthly":
+		days, average = 30, true
+	default:
+		return HttpError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("invalid range, must be one of: daily, weekly, monthly"),
+		}
+	}
+	smooth, err := parseIntParam(q, "smooth", 0)
+	if err != nil {
+		return err
+	}
+	annotate, err := parseAnnotate(q)
+	if err != nil {
+		return err
+	}
+
+	var titles []string
+	var points [][]ServerPoint
+	var all []ServerPoint
+	var maxBucket time.Duration
+	for _, id := range ids {
+		id = a.resolveServerID(id)
+		server, err := a.store.GetServer(r.Context(), id)
+		if err == ErrNotFound {
+			return HttpError{
+				Status: 404,
+				Err:    fmt.Errorf("server not found"),
+			}
+		} else if err != nil {
+			return err
+		}
+		if a.isHubEntry(server) {
+			server.Title = "Global stats"
+		}
+
+		pl, err := a.store.GetSingleServerHistory(r.Context(), id, days)
+		if err != nil {
+			return err
+		}
+		var bucket time.Duration
+		if average {
+			pl = averageHistory(pl, time.Hour)
+			bucket = time.Hour
+		}
+		pl, limited := limitPoints(pl, maxChartPoints)
+		if limited > bucket {
+			bucket = limited
+		}
+		if bucket > maxBucket {
+			maxBucket = bucket
+		}
+		titles = append(titles, server.Title)
+		points = append(points, MovingAverage(pl, smooth))
+		all = append(all, pl...)
+	}
+	if len(all) < 1 {
+		return HttpError{
+			Status: 404,
+			Err:    fmt.Errorf("no history found"),
+		}
+	}
+	if a.cachedChart(w, r, all) {
+		return nil
+	}
+
+	loc := a.parseTimezone(q)
+	c := makeCompareChart(titles, points, a.chartGap(maxBucket), loc)
+	if annotate {
+		annotatePeaks(&c, loc)
+	}
+	return a.renderChart(w, r, c)
 }
 
 func (a *App) pageAverageDailyChart(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
 	id := vars["id"]
-	points, err := a.store.GetSingleServerHistory(id, 30)
+	points, err := a.store.GetSingleServerHistory(r.Context(), id, 30)
 	if err != nil {
 		return err
 	}
@@ -101,14 +755,21 @@ func (a *App) pageAverageDailyChart(w http.ResponseWriter, r *http.Request, vars
 			Err:    fmt.Errorf("server not found"),
 		}
 	}
+	if a.cachedChart(w, r, points) {
+		return nil
+	}
 
-	c := avgDailyChart(points)
-	return a.renderChart(w, c)
+	bands, err := parseBoolParam(r.URL.Query(), "bands")
+	if err != nil {
+		return err
+	}
+	c := avgDailyChart(points, bands, a.parseTimezone(r.URL.Query()))
+	return a.renderChart(w, r, c)
 }
 
 func (a *App) pageAverageHourlyChart(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
 	id := vars["id"]
-	points, err := a.store.GetSingleServerHistory(id, 30)
+	points, err := a.store.GetSingleServerHistory(r.Context(), id, 30)
 	if err != nil {
 		return err
 	}
@@ -118,7 +779,94 @@ func (a *App) pageAverageHourlyChart(w http.ResponseWriter, r *http.Request, var
 			Err:    fmt.Errorf("server not found"),
 		}
 	}
+	if a.cachedChart(w, r, points) {
+		return nil
+	}
+
+	bands, err := parseBoolParam(r.URL.Query(), "bands")
+	if err != nil {
+		return err
+	}
+	c := avgHourlyChart(points, bands, a.parseTimezone(r.URL.Query()))
+	return a.renderChart(w, r, c)
+}
+
+func (a *App) pageHealth(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	open, last := a.getStatus()
+	switch {
+	case !open:
+		return HttpError{
+			Status: http.StatusServiceUnavailable,
+			Err:    fmt.Errorf("storage is not open"),
+		}
+	case last.IsZero():
+		return HttpError{
+			Status: http.StatusServiceUnavailable,
+			Err:    fmt.Errorf("no successful scrape yet"),
+		}
+	case a.isStale(last):
+		return HttpError{
+			Status: http.StatusServiceUnavailable,
+			Err:    fmt.Errorf("last successful scrape is too old"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := fmt.Fprintln(w, "ok")
+	return err
+}
+
+func (a *App) pageHistoryCSV(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	id := vars["id"]
+	server, err := a.store.GetServer(r.Context(), id)
+	if err == ErrNotFound {
+		return HttpError{
+			Status: 404,
+			Err:    fmt.Errorf("server not found"),
+		}
+	} else if err != nil {
+		return err
+	}
+
+	from, to, err := parseTimeRange(r.URL.Query(), 30)
+	if err != nil {
+		return err
+	}
+	loc := a.parseTimezone(r.URL.Query())
+	points, err := a.store.GetServerHistoryRange(r.Context(), id, from, to)
+	if err != nil {
+		return err
+	}
+
+	name := strings.Trim(reFilename.ReplaceAllString(strings.ToLower(server.Title), "_"), "_")
+	if name == "" {
+		name = "server"
+	}
+	// Lets the clients skip downloading it again, if there's no new history
+	// since their copy. Points are sorted with the newest first.
+	if len(points) > 0 && notModified(w, r, points[0].Time) {
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_history.csv"`, name))
+	// It's streamed, so the size isn't known up front, and it's gzipped by
+	// the middleware anyway. The clients will have to download it all again
+	// instead of resuming, but it's small and cheap to remake.
+	w.Header().Set("Accept-Ranges", "none")
 
-	c := avgHourlyChart(points)
-	return a.renderChart(w, c)
+	// The csv writer is buffered and flushes by itself as the buffer fills
+	// up, so the rows are streamed out instead of building it all in memory.
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"timestamp", "players"}); err != nil {
+		return err
+	}
+	for i := len(points) - 1; i >= 0; i-- {
+		p := points[i]
+		err := cw.Write([]string{p.Time.In(loc).Format(time.RFC3339), strconv.Itoa(p.Players)})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
 }
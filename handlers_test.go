@@ -0,0 +1,154 @@
+package ss13_se
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPageHealth(t *testing.T) {
+	a := newTestApp(t, Conf{ScrapeTimeout: time.Minute})
+	now := time.Now()
+	tests := []struct {
+		name       string
+		open       bool
+		lastScrape time.Time
+		want       int
+	}{
+		{"closed storage", false, now, http.StatusServiceUnavailable},
+		{"no scrape", true, time.Time{}, http.StatusServiceUnavailable},
+		{"fresh scrape", true, now, http.StatusOK},
+		{"almost stale", true, now.Add(-2*time.Minute + time.Second), http.StatusOK},
+		{"stale scrape", true, now.Add(-2*time.Minute - time.Second), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		a.setStoreOpen(tt.open)
+		a.setLastScrape(scrapeStats{LastScrape: tt.lastScrape})
+		if w := get(a, "/healthz"); w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d (%s)", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+}
+
+type indexJSON struct {
+	Servers []ServerEntry `json:"servers"`
+	Total   int           `json:"total"`
+	PrevURL string        `json:"prevURL"`
+	NextURL string        `json:"nextURL"`
+}
+
+func getIndexJSON(t *testing.T, a *App, target string) indexJSON {
+	t.Helper()
+	r := httptest.NewRequest("GET", target, nil)
+	r.Header.Set("Accept", "application/json")
+	w := serve(a, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: got status %d, want 200", target, w.Code)
+	}
+	var index indexJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &index); err != nil {
+		t.Fatalf("GET %s: %s", target, err)
+	}
+	return index
+}
+
+func TestIndexMinPlayers(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	servers := append(testServers(),
+		ServerEntry{ID: "d", Title: "Delta Station", Players: 1},
+		ServerEntry{ID: "e", Title: "Echo Station", Players: 0},
+	)
+	if err := updateTestServers(a, time.Now().Truncate(time.Second), servers...); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		total  int
+		titles []string
+		prev   bool
+		next   bool
+	}{
+		{"/", 5, []string{"Alpha Station", "Beta Station", "Delta Station", "Gamma Station", "Echo Station"}, false, false},
+		{"/?minPlayers=0", 5, []string{"Alpha Station", "Beta Station", "Delta Station", "Gamma Station", "Echo Station"}, false, false},
+		{"/?minPlayers=1", 3, []string{"Alpha Station", "Beta Station", "Delta Station"}, false, false},
+		{"/?minPlayers=1&perPage=2", 3, []string{"Alpha Station", "Beta Station"}, false, true},
+		{"/?minPlayers=1&perPage=2&page=2", 3, []string{"Delta Station"}, true, false},
+		{"/?minPlayers=1&perPage=2&sort=-players", 3, []string{"Delta Station", "Beta Station"}, false, true},
+		{"/?minPlayers=7&q=station", 2, []string{"Alpha Station", "Beta Station"}, false, false},
+		{"/?minPlayers=100", 0, nil, false, false},
+	}
+	for _, tt := range tests {
+		index := getIndexJSON(t, a, tt.target)
+		titles := serverTitles(index.Servers)
+		if index.Total != tt.total || strings.Join(titles, ",") != strings.Join(tt.titles, ",") {
+			t.Errorf("GET %s: got %d total and %v, want %d and %v", tt.target, index.Total, titles, tt.total, tt.titles)
+		}
+		if (index.PrevURL != "") != tt.prev || (index.NextURL != "") != tt.next {
+			t.Errorf("GET %s: got prev %q and next %q", tt.target, index.PrevURL, index.NextURL)
+		}
+		if tt.next && !strings.Contains(index.NextURL, "minPlayers=1") {
+			t.Errorf("GET %s: got next %q, want it to keep the filter", tt.target, index.NextURL)
+		}
+	}
+
+	got := serverTitles(getServersJSON(t, a, "/api/servers?minPlayers=7&includeHub=true"))
+	if want := internalServerTitle + ",Alpha Station,Beta Station"; strings.Join(got, ",") != want {
+		t.Errorf("got %v from the API, want %s", got, want)
+	}
+	if w := get(a, "/?minPlayers=-1"); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a negative minPlayers, want 400", w.Code)
+	}
+}
+
+func TestHistoryCSV(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	// Aligned to the history rounding
+	now := time.Now().Truncate(a.historyRounding())
+	for _, d := range []time.Duration{2 * time.Hour, time.Hour} {
+		if err := updateTestServers(a, now.Add(-d), testServers()[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := get(a, "/server/a/history.csv?tz=UTC")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("got status %d and type %q, want a csv", w.Code, w.Header().Get("Content-Type"))
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="alpha_station_history.csv"` {
+		t.Errorf("got Content-Disposition %q", got)
+	}
+	want := "timestamp,players\n" +
+		now.Add(-2*time.Hour).UTC().Format(time.RFC3339) + ",42\n" +
+		now.Add(-time.Hour).UTC().Format(time.RFC3339) + ",42\n"
+	if body := w.Body.String(); body != want {
+		t.Errorf("got csv %q, want %q", body, want)
+	}
+
+	modified := w.Header().Get("Last-Modified")
+	if modified != now.Add(-time.Hour).UTC().Format(http.TimeFormat) {
+		t.Errorf("got Last-Modified %q, want the time of the newest point", modified)
+	}
+	r := httptest.NewRequest("GET", "/server/a/history.csv?tz=UTC", nil)
+	r.Header.Set("If-Modified-Since", modified)
+	if w := serve(a, r); w.Code != http.StatusNotModified || w.Body.Len() > 0 {
+		t.Errorf("got status %d with %d bytes, want 304", w.Code, w.Body.Len())
+	}
+
+	// Ranges aren't supported, as it's streamed
+	if got := w.Header().Get("Accept-Ranges"); got != "none" {
+		t.Errorf("got Accept-Ranges %q, want none", got)
+	}
+	r = httptest.NewRequest("GET", "/server/a/history.csv?tz=UTC", nil)
+	r.Header.Set("Range", "bytes=0-9")
+	if w := serve(a, r); w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("got status %d and csv %q for a Range request, want all of it", w.Code, w.Body.String())
+	}
+
+	if w := get(a, "/server/missing/history.csv"); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a missing server, want 404", w.Code)
+	}
+}
@@ -0,0 +1,87 @@
+package ss13_se
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Sizes of the heatmap, in pixels
+const (
+	heatmapCellW   = 32
+	heatmapCellH   = 24
+	heatmapLabelW  = 90
+	heatmapLabelH  = 24
+	heatmapPadding = 10
+)
+
+// Draws the heatmap as a SVG grid, with a row per weekday (starting on
+// monday) and a column per hour. Darker cells had more players.
+func renderHeatmap(w io.Writer, hm heatmap, t Theme) error {
+	bg, fg := "#fff", "#444"
+	if t == ThemeDark {
+		bg, fg = "#1e1e1e", "#ccc"
+	}
+	max := hm.max()
+	width := heatmapPadding*2 + heatmapLabelW + 24*heatmapCellW
+	height := heatmapPadding*2 + heatmapLabelH + 7*heatmapCellH
+
+	// Written as it goes, any errors are kept until the final flush
+	buf := bufio.NewWriter(w)
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="12">`+"\n",
+		width, height, width, height)
+	fmt.Fprintf(buf, `<rect width="%d" height="%d" fill="%s"/>`+"\n", width, height, bg)
+
+	x0, y0 := heatmapPadding+heatmapLabelW, heatmapPadding+heatmapLabelH
+	for h := 0; h < 24; h++ {
+		fmt.Fprintf(buf, `<text x="%d" y="%d" text-anchor="middle" fill="%s">%02d</text>`+"\n",
+			x0+h*heatmapCellW+heatmapCellW/2, y0-8, fg, h)
+	}
+	for row, d := range weekDaysOrder {
+		y := y0 + row*heatmapCellH
+		fmt.Fprintf(buf, `<text x="%d" y="%d" fill="%s">%s</text>`+"\n",
+			heatmapPadding, y+heatmapCellH/2+4, fg, d)
+		for h := 0; h < 24; h++ {
+			b := hm[d][h]
+			fmt.Fprintf(buf, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s" stroke="%s"><title>%s %02d:00, avg. %.1f players (%d samples)</title></rect>`+"\n",
+				x0+h*heatmapCellW, y, heatmapCellW, heatmapCellH, heatColor(b.Avg, max), bg, d, h, b.Avg, b.Samples)
+		}
+	}
+	fmt.Fprint(buf, "</svg>\n")
+	return buf.Flush()
+}
+
+// Returns a blue color, that gets darker the closer v is to max
+func heatColor(v, max float64) string {
+	f := 0.0
+	if max > 0 {
+		f = v / max
+	}
+	// From a light gray (238, 238, 238) to a dark blue (0, 60, 140)
+	mix := func(from, to int) int {
+		return from + int(f*float64(to-from))
+	}
+	return fmt.Sprintf("#%02x%02x%02x", mix(238, 0), mix(238, 60), mix(238, 140))
+}
+
+func (a *App) pageHeatmap(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	id := vars["id"]
+	points, err := a.store.GetSingleServerHistory(r.Context(), id, 30)
+	if err != nil {
+		return err
+	}
+	if len(points) < 1 {
+		return HttpError{
+			Status: 404,
+			Err:    fmt.Errorf("server not found"),
+		}
+	}
+	if a.cachedChart(w, r, points) {
+		return nil
+	}
+
+	hm := heatmapHistory(points, a.parseTimezone(r.URL.Query()))
+	w.Header().Set("Content-Type", "image/svg+xml")
+	return renderHeatmap(w, hm, parseTheme(r.URL.Query().Get("theme")))
+}
@@ -1,45 +1,370 @@
 package ss13_se
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"html/template"
-	"log"
+	"io/fs"
+	"log/slog"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/gorilla/mux"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
-	// Used internally for logging a global # of players
+	// Default title of the internal hub entry, used to count total players
 	internalServerTitle string = "_ss13.se"
 
-	// How old a server entry can get, without updates, before it get's deleted
-	oldServerTimeout = 24 * 3 // in hours
+	// Defaults for the web server and scraper timeouts
+	defaultReadTimeout   = 30 * time.Second
+	defaultWriteTimeout  = 30 * time.Second
+	defaultScrapeTimeout = 15 * time.Minute
+
+	// Don't want to hammer the byond hub
+	minScrapeTimeout = 30 * time.Second
+
+	// Default for how old a server entry can get, without updates, before it get's deleted
+	defaultOldServerTimeout = 72 * time.Hour
+
+	// Defaults for how many times, and how long between, a failed scrape is retried
+	defaultScrapeRetries     = 3
+	defaultScrapeRetryDelay  = 5 * time.Second
+	defaultScrapeConcurrency = 4
+
+	// How often the history retention job is run
+	retentionInterval = 1 * time.Hour
+
+	// Default bucket size when downsampling old history
+	defaultHistoryDownsampleBucket = 1 * time.Hour
+
+	// How long to wait for open connections to finish when shutting down
+	shutdownTimeout = 30 * time.Second
+
+	// Default for Conf.AutocertCacheDir
+	defaultAutocertCacheDir = "autocert"
+
+	// How often a web only instance checks the storage for new scrapes
+	refreshInterval = 1 * time.Minute
 )
 
 type Conf struct {
 	// Web stuff
-	WebAddr      string
+	WebAddr string
+	// Serves all the pages under this path instead of the root, like "/ss13",
+	// for running behind a reverse proxy that's forwarding a subpath as it is
+	BasePath string
+	// Turns off the request logging, useful when running behind another
+	// web server that's doing it already
+	DisableAccessLog bool
+	// Both defaults to 30 seconds if left zero
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+	// Serves HTTPS using these files, instead of plain HTTP
+	TLSCertFile string
+	TLSKeyFile  string
+	// Serves HTTPS using certs from Let's Encrypt, for these domains.
+	// The certs are cached in AutocertCacheDir (defaults to "autocert" if left
+	// empty). Can't be used together with the TLS files above.
+	AutocertDomains  []string
+	AutocertCacheDir string
+	// Origins (like "https://example.com") allowed to use the API from a browser,
+	// or "*" for any. No CORS headers are sent if left empty.
+	AllowedOrigins []string
+	// Max requests per second from a single client IP, with bursts of up to
+	// RateLimitBurst (defaults to 10 if left zero). Disabled if left zero.
+	RateLimit      float64
+	RateLimitBurst int
+	// Uses the X-Forwarded-For header for finding the client IP, only enable
+	// it when running behind a trusted proxy that's setting it
+	TrustProxyHeaders bool
+	// Served as /robots.txt. Defaults to disallowing the charts and CSV
+	// downloads if left empty, so crawlers doesn't render all of them.
+	RobotsTxt string
+	// The history charts breaks their lines where there's no points for
+	// longer than this, instead of drawing over the downtime. Defaults to
+	// twice the ScrapeTimeout if left zero, set to negative to disable.
+	ChartGapThreshold time.Duration
+	// Sites allowed to show the /server/{id}/embed pages in iframes, as
+	// sources for the CSP frame-ancestors (like "https://example.com").
+	// Any site can if left empty.
+	EmbedAncestors []string
+	// Credentials for the /admin routes, which can be requested with either
+	// the AdminToken as a bearer token or the user and password with basic
+	// auth. The admin routes are disabled if none of them are set.
+	AdminToken    string
+	AdminUser     string
+	AdminPassword string
 
 	// Scraper stuff
+	// Time to wait between each scrape. Defaults to 15 minutes if left zero
+	// and can't be lower than 30 seconds.
 	ScrapeTimeout time.Duration
+	// Randomly moves each wait between the scrapes by up to this fraction of
+	// the ScrapeTimeout, like 0.1 for +-10%, so multiple instances doesn't
+	// hit byond at the same time. Disabled if left zero, must be below 1.
+	ScrapeJitter float64
+	// Servers that hasn't been updated in this long will be removed, together
+	// with their history. Defaults to 72 hours if left zero.
+	OldServerTimeout time.Duration
+	// How many times a failed scrape is retried before giving up for
+	// the current cycle. Defaults to 3 if left zero, set to negative to disable.
+	ScrapeRetries int
+	// Initial delay between retries, doubled after each failed attempt.
+	// Defaults to 5 seconds if left zero.
+	ScrapeRetryDelay time.Duration
+	// Only logs the "Scrape done" summary for every Nth successful scrape,
+	// to keep the logs readable with a short ScrapeTimeout. The errors are
+	// always logged. Defaults to 1 (every scrape) if left zero.
+	LogEveryNScrapes int
+	// Which field is used to detect duplicate servers in a scrape. Defaults
+	// to the game url if left empty, falling back to the title for servers
+	// without one (like their IDs).
+	DedupeKey DedupeKey
+	// Used for looking up where the servers are hosted. Disabled if left nil.
+	GeoResolver GeoResolver
+	// Used by the scraper for all outgoing requests. Defaults to a client
+	// with a 60 second timeout if left nil.
+	HTTPClient *http.Client
+	// Routes the scraper's requests through this proxy, like
+	// "http://proxy.example.com:3128". Uses a direct connection if left empty.
+	// Ignored if a HTTPClient is set, which takes precedence.
+	ProxyURL string
+	// Sent with all outgoing requests. Defaults to a "ss13hub/..." one if left empty.
+	ScrapeUserAgent string
+	// Max number of per server lookups running at the same time, during
+	// a scrape. That's only the country lookups for now (see GeoResolver),
+	// as the hub page has all the other details. Defaults to 4 if left zero.
+	ScrapeConcurrency int
+	// Which byond hubs to scrape, like "Exadv1/SpaceStation13" for
+	// byond.com/games/Exadv1/SpaceStation13. Defaults to the SS13 hub only
+	// if left empty.
+	HubSources []string
+	// Servers that are never tracked or shown, matched by their exact ID or
+	// by their title with any of the regexps in BlockedTitles (like
+	// "(?i)spam"). Already stored servers are removed on the next update,
+	// together with their history.
+	BlockedServerIDs []string
+	BlockedTitles    []string
+
+	// History retention stuff
+	// History older than this is downsampled to averages per
+	// HistoryDownsampleBucket (defaults to 1 hour). Disabled if left zero.
+	HistoryFullResolution   time.Duration
+	HistoryDownsampleBucket time.Duration
+	// History older than this is removed. Disabled if left zero.
+	HistoryMaxAge time.Duration
+
+	// Alert stuff
+	// A JSON payload is POSTed to this URL when any of the watched servers
+	// goes offline or comes back online
+	AlertWebhookURL  string
+	WatchedServerIDs []string
+	// Servers that gets a weekly digest of their players, sent to the
+	// DigestSink when the updater runs in a new week (or logged if the sink
+	// is left nil). See BuildWeeklyDigest.
+	DigestServerIDs []string
+	DigestSink      DigestSink
 
 	// Misc.
+	// Runs only the updater or only the web server, like when a single
+	// scraper is saving to a storage shared by multiple web servers (which
+	// must support it, like StoragePostgres). Can't both be set.
+	DisableWeb     bool
+	DisableScraper bool
+	// Where everything is saved, like NewStorageSqlite("servers.db") for the
+	// default file database. Opened by Run and closed when it returns.
 	Storage Storage
+	// Title of the internal entry keeping track of the total players, which
+	// is hidden from the server lists. Defaults to "_ss13.se" if left empty.
+	// Changing it starts a new history, as the ID is made from the title.
+	InternalTitle string
+	// Defaults to a text logger writing to stderr if left nil
+	Logger *slog.Logger
+	// Reads the templates and static files from the "templates" and "static"
+	// dirs, in the current working directory, instead of the ones embedded in
+	// the binary. The templates are also reloaded on each request.
+	DevMode bool
 }
 
 type App struct {
 	conf      Conf
 	web       *http.Server
 	store     Storage
+	assets    fs.FS
 	templates map[string]*template.Template
-	hub       ServerEntry // TODO: probably needs to be protected with a lock
+	log       *slog.Logger
+	rand      *rand.Rand // Only used by the updater
+
+	lastRetention time.Time      // Only used by the updater
+	scrapesDone   int            // Same, for the LogEveryNScrapes
+	lastDigest    time.Time      // Same, the start of the last sent week, see runDigests
+	digests       sync.WaitGroup // The digests being sent, waited for by Run
+
+	webClient   *http.Client // Only used by the updater
+	alertClient *http.Client
+	watched     map[string]bool
+	blocked     map[string]bool
+	blockedRe   []*regexp.Regexp
+	metrics     *metrics
+	limiter     *rateLimiter
+	routeTable  []route
+
+	hubLock sync.RWMutex
+	hub     ServerEntry
+
+	statusLock sync.RWMutex
+	storeOpen  bool
+	lastStats  scrapeStats // From the last successful scrape
+	updater    updaterStatus
+
+	// Servers from the last update, see getServersPage
+	serversLock   sync.RWMutex
+	servers       []ServerEntry
+	serversLoaded time.Time
+
+	trendLock sync.RWMutex
+	trends    map[string]Trend
+
+	// Countries by host, so they're not looked up again on each scrape
+	geoLock  sync.Mutex
+	geoCache map[string]geoEntry
+
+	// Forced scrapes from the admin route, see apiAdminScrape
+	scrapeNow chan chan scrapeResult
+}
+
+// Summary of the last successful scrape
+type scrapeStats struct {
+	TotalPlayers int       `json:"totalPlayers"`
+	ServerCount  int       `json:"serverCount"`
+	LastScrape   time.Time `json:"lastScrape"`
 }
 
 func New(c Conf) (*App, error) {
-	templates, err := loadTemplates()
+	if c.Storage == nil {
+		return nil, fmt.Errorf("conf: missing Storage")
+	}
+	if c.DisableWeb && c.DisableScraper {
+		return nil, fmt.Errorf("conf: can't use both DisableWeb and DisableScraper")
+	}
+	if c.WebAddr == "" && !c.DisableWeb {
+		return nil, fmt.Errorf("conf: missing WebAddr")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return nil, fmt.Errorf("conf: both TLSCertFile and TLSKeyFile must be set")
+	}
+	if len(c.AutocertDomains) > 0 && c.TLSCertFile != "" {
+		return nil, fmt.Errorf("conf: can't use both AutocertDomains and TLSCertFile")
+	}
+	if (c.AdminUser == "") != (c.AdminPassword == "") {
+		return nil, fmt.Errorf("conf: both AdminUser and AdminPassword must be set")
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = defaultReadTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	if c.AutocertCacheDir == "" {
+		c.AutocertCacheDir = defaultAutocertCacheDir
+	}
+	if c.RateLimitBurst == 0 {
+		c.RateLimitBurst = defaultRateLimitBurst
+	}
+	if c.InternalTitle == "" {
+		c.InternalTitle = internalServerTitle
+	}
+	c.BasePath = strings.TrimRight(c.BasePath, "/")
+	if c.BasePath != "" && !strings.HasPrefix(c.BasePath, "/") {
+		c.BasePath = "/" + c.BasePath
+	}
+	if strings.ContainsAny(c.BasePath, "?#") {
+		return nil, fmt.Errorf("conf: BasePath can't have a query or fragment")
+	}
+	if c.RobotsTxt == "" {
+		c.RobotsTxt = strings.ReplaceAll(defaultRobotsTxt, "Disallow: /", "Disallow: "+c.BasePath+"/")
+	}
+	if c.ScrapeTimeout == 0 {
+		c.ScrapeTimeout = defaultScrapeTimeout
+	}
+	if c.ScrapeTimeout < minScrapeTimeout {
+		return nil, fmt.Errorf("conf: ScrapeTimeout must be at least %s", minScrapeTimeout)
+	}
+	if c.ScrapeJitter < 0 || c.ScrapeJitter >= 1 {
+		return nil, fmt.Errorf("conf: ScrapeJitter must be between 0 and 1")
+	}
+	var blockedTitles []*regexp.Regexp
+	for _, s := range c.BlockedTitles {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("conf: invalid BlockedTitles %q: %w", s, err)
+		}
+		blockedTitles = append(blockedTitles, re)
+	}
+	if c.ChartGapThreshold == 0 {
+		c.ChartGapThreshold = 2 * c.ScrapeTimeout
+	}
+	if c.HistoryDownsampleBucket == 0 {
+		c.HistoryDownsampleBucket = defaultHistoryDownsampleBucket
+	}
+	if c.Logger == nil {
+		c.Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+	if c.OldServerTimeout == 0 {
+		c.OldServerTimeout = defaultOldServerTimeout
+	}
+	if c.ScrapeRetries == 0 {
+		c.ScrapeRetries = defaultScrapeRetries
+	}
+	if c.ScrapeRetryDelay == 0 {
+		c.ScrapeRetryDelay = defaultScrapeRetryDelay
+	}
+	if c.LogEveryNScrapes == 0 {
+		c.LogEveryNScrapes = 1
+	}
+	if c.LogEveryNScrapes < 0 {
+		return nil, fmt.Errorf("conf: LogEveryNScrapes can't be negative")
+	}
+	if c.ScrapeUserAgent == "" {
+		c.ScrapeUserAgent = userAgent
+	}
+	if len(c.HubSources) == 0 {
+		c.HubSources = []string{defaultHubSource}
+	}
+	if c.ScrapeConcurrency == 0 {
+		c.ScrapeConcurrency = defaultScrapeConcurrency
+	}
+
+	webClient := c.HTTPClient
+	if webClient == nil {
+		webClient = &http.Client{
+			Timeout: 60 * time.Second,
+		}
+	}
+	if c.HTTPClient == nil && c.ProxyURL != "" {
+		u, err := url.Parse(c.ProxyURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("conf: invalid ProxyURL: %q", c.ProxyURL)
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = http.ProxyURL(u)
+		webClient.Transport = t
+	}
+
+	var assets fs.FS = embeddedAssets
+	if c.DevMode {
+		assets = os.DirFS(".")
+	}
+	templates, err := loadTemplates(assets, c.BasePath)
 	if err != nil {
 		return nil, err
 	}
@@ -49,79 +374,376 @@ func New(c Conf) (*App, error) {
 		ReadTimeout:  c.ReadTimeout,
 		WriteTimeout: c.WriteTimeout,
 	}
+	if len(c.AutocertDomains) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.AutocertDomains...),
+			Cache:      autocert.DirCache(c.AutocertCacheDir),
+		}
+		w.TLSConfig = m.TLSConfig()
+	}
 
 	a := &App{
 		conf:      c,
 		web:       w,
 		store:     c.Storage,
+		log:       c.Logger,
+		assets:    assets,
 		templates: templates,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		metrics:   newMetrics(),
+
+		webClient:   webClient,
+		alertClient: &http.Client{Timeout: alertTimeout},
+		watched:     make(map[string]bool),
+		blocked:     make(map[string]bool),
+		blockedRe:   blockedTitles,
+		geoCache:    make(map[string]geoEntry),
+		scrapeNow:   make(chan chan scrapeResult),
+	}
+	for _, id := range c.WatchedServerIDs {
+		a.watched[id] = true
+	}
+	for _, id := range c.BlockedServerIDs {
+		a.blocked[id] = true
 	}
 
-	r := mux.NewRouter()
-	r.Handle("/", handler(a.pageIndex))
-	r.Handle("/static/style.css", handler(a.pageStyle))
-	r.Handle("/server/{id}", handler(a.pageServer))
-	r.Handle("/server/{id}/daily", handler(a.pageDailyChart))
-	r.Handle("/server/{id}/weekly", handler(a.pageWeeklyChart))
-	r.Handle("/server/{id}/averagedaily", handler(a.pageAverageDailyChart))
-	r.Handle("/server/{id}/averagehourly", handler(a.pageAverageHourlyChart))
-	a.web.Handler = r
+	a.routeTable = a.routes()
+	r := a.newRouter()
+	var h http.Handler = gzipHandler(a.recoverHandler(r))
+	if c.RateLimit > 0 {
+		a.limiter = newRateLimiter(c.RateLimit, c.RateLimitBurst)
+		h = a.rateLimitHandler(h)
+	}
+	if !c.DisableAccessLog {
+		h = a.logHandler(h)
+	}
+	a.web.Handler = h
 
 	return a, nil
 }
 
-func (a *App) Log(msg string, args ...interface{}) {
-	log.Printf(msg+"\n", args...)
-}
-
-func (a *App) Run() error {
-	a.Log("Opening storage...")
-	err := a.store.Open()
+// Run opens the storage and starts the updater and web server (unless
+// disabled in the Conf). It blocks until ctx is cancelled, or the web server
+// fails, and then shuts everything down.
+func (a *App) Run(ctx context.Context) error {
+	a.log.Info("Opening storage...")
+	err := a.store.Open(ctx)
 	if err != nil {
 		return err
 	}
+	a.setStoreOpen(true)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	webClient := &http.Client{
-		Timeout: 60 * time.Second,
+	updaterDone := make(chan struct{})
+	go func() {
+		if a.conf.DisableScraper {
+			a.log.Info("Scraper disabled, only refreshing from storage")
+			a.runRefresher(ctx)
+		} else {
+			a.log.Info("Running updater")
+			a.runUpdater(ctx, a.webClient)
+		}
+		close(updaterDone)
+	}()
+
+	// Never receives anything if the web server is disabled
+	webErr := make(chan error, 1)
+	if !a.conf.DisableWeb {
+		a.log.Info("Running server", "addr", a.conf.WebAddr)
+		go func() {
+			webErr <- a.listen()
+		}()
 	}
 
-	a.Log("Running updater")
-	go a.runUpdater(webClient)
+	select {
+	case <-ctx.Done():
+		a.log.Info("Shutting down...")
+		if !a.conf.DisableWeb {
+			sctx, scancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer scancel()
+			err = a.web.Shutdown(sctx)
+		}
+	case err = <-webErr:
+	}
+
+	// Aborts any in-flight scrape and waits for the updater to return,
+	// before closing the storage
+	cancel()
+	<-updaterDone
+	a.digests.Wait()
+
+	a.setStoreOpen(false)
+	if e := a.store.Close(); err == nil {
+		err = e
+	}
+	return err
+}
 
-	a.Log("Running server on %s", a.conf.WebAddr)
+// Starts the web server, using HTTPS if it's been configured
+func (a *App) listen() error {
+	switch {
+	case a.web.TLSConfig != nil:
+		// The certs are handled by autocert
+		return a.web.ListenAndServeTLS("", "")
+	case a.conf.TLSCertFile != "":
+		return a.web.ListenAndServeTLS(a.conf.TLSCertFile, a.conf.TLSKeyFile)
+	}
 	return a.web.ListenAndServe()
 }
 
-func (a *App) runUpdater(webClient *http.Client) {
+func (a *App) runUpdater(ctx context.Context, webClient *http.Client) {
+	a.runUpdate(ctx, webClient)
 	for {
-		now := time.Now()
-		servers, err := scrapeByond(webClient, now)
-		dur := time.Since(now)
-		if err != nil {
-			a.Log("Scrape done in %s, errors: %v", dur, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.scrapeWait()):
+			a.runUpdate(ctx, webClient)
+		case reply := <-a.scrapeNow:
+			reply <- a.runUpdate(ctx, webClient)
 		}
+	}
+}
 
-		if err == nil {
-			servers = append(servers, a.makeHubEntry(now, servers))
+// Keeps the hub entry, stats and trends up to date from the storage, instead
+// of the scraper doing it after each scrape. Used when another instance is
+// doing the scraping.
+func (a *App) runRefresher(ctx context.Context) {
+	for {
+		if err := a.refresh(ctx); err != nil {
+			a.log.Error("Error refreshing from storage", "err", err)
+		}
 
-			if err := a.store.SaveServers(servers); err != nil {
-				a.Log("Error saving servers: %s", err)
-			}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(refreshInterval):
+		}
+	}
+}
 
-			if err := a.updateHistory(now, servers); err != nil {
-				a.Log("Error saving server history: %s", err)
-			}
+func (a *App) refresh(ctx context.Context) error {
+	hub, err := a.store.GetServer(ctx, a.hubID())
+	if err == ErrNotFound {
+		// Nothing has been scraped yet
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !hub.Time.After(a.getStats().LastScrape) {
+		return nil
+	}
 
-			if err := a.updateOldServers(now); err != nil {
-				a.Log("Error updating old servers: %s", err)
-			}
+	servers, err := a.store.GetServers(ctx)
+	if err != nil {
+		return err
+	}
+	a.hubLock.Lock()
+	a.hub = hub
+	a.hubLock.Unlock()
+	a.cacheServers(servers, hub.Time)
+	if err := a.updateTrends(ctx, hub.Time, servers); err != nil {
+		return err
+	}
+	counts, err := a.store.GetServerCounts(ctx, 1)
+	if err != nil {
+		return err
+	}
+	stats := scrapeStats{
+		TotalPlayers: hub.Players,
+		LastScrape:   hub.Time,
+	}
+	if len(counts) > 0 {
+		stats.ServerCount = counts[0].Servers
+	}
+	a.setLastScrape(stats)
+	return nil
+}
+
+// Returns the ScrapeTimeout, moved by a random amount within the ScrapeJitter
+func (a *App) scrapeWait() time.Duration {
+	wait := a.conf.ScrapeTimeout
+	if a.conf.ScrapeJitter <= 0 {
+		return wait
+	}
+	max := float64(wait) * a.conf.ScrapeJitter
+	return wait + time.Duration((a.rand.Float64()*2-1)*max)
+}
+
+// Runs a single scrape and update cycle. Any panics are logged and recovered,
+// so a bad cycle doesn't kill the whole updater.
+func (a *App) runUpdate(ctx context.Context, webClient *http.Client) (res scrapeResult) {
+	now := time.Now()
+	// Runs last, so it also gets the recovered panics
+	defer func() {
+		a.setUpdaterStatus(now, res)
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			a.log.Error("Recovered from panic in updater", "panic", r, "stack", string(debug.Stack()))
+			res.Error = fmt.Sprintf("panic: %v", r)
 		}
+	}()
+
+	servers, err := a.scrape(ctx, webClient, now)
+	dur := time.Since(now)
+	res.Duration = dur.Seconds()
+	if err != nil {
+		res.Error = err.Error()
+	}
+	a.metrics.scrapes.Inc()
+	a.metrics.scrapeDuration.Observe(dur.Seconds())
+	var partial partialScrapeError
+	if errors.As(err, &partial) {
+		// Still saving the servers that was found
+		a.metrics.scrapeErrors.Inc()
+		a.log.Warn("Scrape partially failed", "duration", dur, "errors", len(partial.Errs), "err", err)
+	} else if err != nil {
+		a.metrics.scrapeErrors.Inc()
+		a.log.Error("Scrape failed", "duration", dur, "err", err)
+		return res
+	}
+
+	servers = a.removeBlocked(dedupeServers(servers, a.conf.DedupeKey))
+	a.resolveCountries(ctx, servers)
+	hub := a.makeHubEntry(now, servers)
+	a.metrics.servers.Set(float64(len(servers)))
+	a.metrics.players.Set(float64(hub.Players))
+	servers = append(servers, hub)
+	if a.scrapesDone%a.conf.LogEveryNScrapes == 0 {
+		a.log.Info("Scrape done", "duration", dur, "servers", len(servers)-1, "players", hub.Players)
+	}
+	a.scrapesDone++
+	res.ServerCount = len(servers) - 1
 
-		time.Sleep(a.conf.ScrapeTimeout)
+	if err := a.updateServers(ctx, now, servers); err != nil {
+		a.log.Error("Error updating servers", "err", err)
+		res.Error = err.Error()
+	} else {
+		a.setLastScrape(scrapeStats{
+			TotalPlayers: hub.Players,
+			ServerCount:  len(servers) - 1,
+			LastScrape:   now,
+		})
+		res.saved = true
+		count := ServerCount{Time: now, Servers: len(servers) - 1}
+		if err := a.store.SaveServerCount(ctx, count); err != nil {
+			a.log.Error("Error saving server count", "err", err)
+		}
+		if err := a.updateTrends(ctx, now, servers); err != nil {
+			a.log.Error("Error updating trends", "err", err)
+		}
 	}
+
+	a.runRetention(ctx, now)
+	a.runDigests(ctx, now)
+	return res
 }
 
-func (a *App) updateHistory(t time.Time, servers []ServerEntry) error {
+// Removes and downsamples old history, according to the Conf.
+// Runs at most once per retentionInterval.
+func (a *App) runRetention(ctx context.Context, now time.Time) {
+	if now.Sub(a.lastRetention) < retentionInterval {
+		return
+	}
+	a.lastRetention = now
+
+	if a.conf.HistoryMaxAge > 0 {
+		if err := a.store.RemoveOldHistory(ctx, now.Add(-a.conf.HistoryMaxAge)); err != nil {
+			a.log.Error("Error removing old history", "err", err)
+		}
+	}
+	if a.conf.HistoryFullResolution > 0 {
+		before := now.Add(-a.conf.HistoryFullResolution)
+		if err := a.store.DownsampleHistory(ctx, before, a.conf.HistoryDownsampleBucket); err != nil {
+			a.log.Error("Error downsampling history", "err", err)
+		}
+	}
+
+	// Only checked here, as counting all the history isn't free
+	if stats, err := a.store.Stats(ctx); err != nil {
+		a.log.Error("Error getting storage stats", "err", err)
+	} else {
+		a.metrics.historyPoints.Set(float64(stats.HistoryPoints))
+	}
+}
+
+func (a *App) setStoreOpen(open bool) {
+	a.statusLock.Lock()
+	a.storeOpen = open
+	a.statusLock.Unlock()
+}
+
+func (a *App) setLastScrape(stats scrapeStats) {
+	a.statusLock.Lock()
+	a.lastStats = stats
+	a.statusLock.Unlock()
+}
+
+// Returns the stats from the last successful scrape, which is only updated
+// after all the servers has been saved.
+func (a *App) getStats() scrapeStats {
+	a.statusLock.RLock()
+	defer a.statusLock.RUnlock()
+	return a.lastStats
+}
+
+// Returns if the store is open and the time of the last successful scrape
+func (a *App) getStatus() (bool, time.Time) {
+	a.statusLock.RLock()
+	defer a.statusLock.RUnlock()
+	return a.storeOpen, a.lastStats.LastScrape
+}
+
+// Tries to scrape byond, retrying with an exponential backoff (with some random
+// jitter) on failures. Partial failures aren't retried, as there's still some
+// servers to save (see scrapeByond).
+func (a *App) scrape(ctx context.Context, webClient *http.Client, now time.Time) ([]ServerEntry, error) {
+	delay := a.conf.ScrapeRetryDelay
+	for attempt := 0; ; attempt++ {
+		servers, err := scrapeByond(ctx, a.log, webClient, a.conf.ScrapeUserAgent, a.conf.HubSources, now)
+		var partial partialScrapeError
+		if err == nil || errors.As(err, &partial) || attempt >= a.conf.ScrapeRetries {
+			return servers, err
+		}
+
+		wait := delay + time.Duration(a.rand.Int63n(int64(delay/2)+1))
+		var limited rateLimitError
+		if errors.As(err, &limited) {
+			if limited.RetryAfter > 0 {
+				wait = limited.RetryAfter
+			}
+			// No point waiting longer than until the next cycle anyway
+			if wait > a.conf.ScrapeTimeout {
+				a.log.Warn("Scrape rate limited, skipping this cycle", "attempt", attempt+1, "retryAfter", wait)
+				return nil, err
+			}
+			a.log.Warn("Scrape rate limited, backing off", "attempt", attempt+1, "wait", wait)
+		} else {
+			a.log.Warn("Scrape attempt failed, retrying", "attempt", attempt+1, "wait", wait, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// Rounding of the history times, so the points from a re-scrape in the same
+// cycle (like after a restart) replaces the old ones instead of being saved
+// twice. It's half the shortest possible wait between two scrapes, so the
+// normal ones always ends up in different rounds.
+func (a *App) historyRounding() time.Duration {
+	return time.Duration(float64(a.conf.ScrapeTimeout) * (1 - a.conf.ScrapeJitter) / 2)
+}
+
+func (a *App) updateHistory(ctx context.Context, t time.Time, servers []ServerEntry) error {
+	t = t.Truncate(a.historyRounding())
 	var history []ServerPoint
 	for _, s := range servers {
 		history = append(history, ServerPoint{
@@ -130,58 +752,271 @@ func (a *App) updateHistory(t time.Time, servers []ServerEntry) error {
 			Players:  s.Players,
 		})
 	}
-	return a.store.SaveServerHistory(history)
+	defer a.metrics.observeWrite("history", time.Now())
+	return a.store.SaveServerHistory(ctx, history)
 }
 
-func (a *App) updateOldServers(t time.Time) error {
-	servers, err := a.store.GetServers()
+// Saves the scraped servers, together with the old servers that wasn't seen
+// in this scrape, and then saves the history for all of them in a single batch.
+func (a *App) updateServers(ctx context.Context, t time.Time, servers []ServerEntry) error {
+	stored, err := a.store.GetServers(ctx)
 	if err != nil {
 		return err
 	}
+	if stored, err = a.removeBlockedServers(ctx, stored); err != nil {
+		return err
+	}
+	if err := a.trackRenames(ctx, stored, servers); err != nil {
+		return err
+	}
+	events := a.findServerEvents(t, stored, servers)
+	for i := range servers {
+		servers[i].LastSeen = t
+	}
+
+	old, err := a.updateOldServers(ctx, t, stored, servers)
+	if err != nil {
+		return err
+	}
+	servers = append(servers, old...)
 
+	if err := a.saveServers(ctx, servers); err != nil {
+		return err
+	}
+	a.cacheServers(servers, t)
+	if err := a.updateHistory(ctx, t, servers); err != nil {
+		return err
+	}
+
+	if len(events) > 0 {
+		if err := a.store.SaveServerEvents(ctx, events); err != nil {
+			return err
+		}
+		a.sendAlerts(events, append(stored, servers...))
+	}
+	return nil
+}
+
+// Removes any stored servers that has been blocked since they were saved,
+// returning the ones left
+func (a *App) removeBlockedServers(ctx context.Context, stored []ServerEntry) ([]ServerEntry, error) {
+	keep := a.removeBlocked(stored)
+	if len(keep) == len(stored) {
+		return stored, nil
+	}
 	var remove []ServerEntry
-	var update []ServerEntry
-	for _, s := range servers {
-		delta := t.Sub(s.Time)
-		switch {
-		case delta.Hours() > oldServerTimeout:
+	for _, s := range stored {
+		if !a.isHubEntry(s) && a.isBlocked(s) {
 			remove = append(remove, s)
-		case !s.Time.Equal(t):
-			s.Players = 0
-			update = append(update, s)
 		}
 	}
+	a.log.Info("Removing blocked servers", "servers", len(remove))
+	if err := a.store.RemoveServers(ctx, remove); err != nil {
+		return nil, err
+	}
+	return keep, nil
+}
 
-	if len(remove) > 0 {
-		if err := a.store.RemoveServers(remove); err != nil {
-			return err
+func (a *App) saveServers(ctx context.Context, servers []ServerEntry) error {
+	defer a.metrics.observeWrite("servers", time.Now())
+	return a.store.SaveServers(ctx, servers)
+}
+
+// Compares the previously stored servers with the current ones, to find the
+// servers that went online or offline since the last scrape.
+// NOTE: empty servers are skipped by the scraper, so they count as offline too.
+func (a *App) findServerEvents(t time.Time, stored, current []ServerEntry) []ServerEvent {
+	online := make(map[string]bool)
+	for _, s := range stored {
+		online[s.ID] = s.Players > 0
+	}
+
+	var events []ServerEvent
+	seen := make(map[string]bool)
+	for _, s := range current {
+		seen[s.ID] = true
+		if a.isHubEntry(s) || online[s.ID] {
+			continue
+		}
+		events = append(events, ServerEvent{ServerID: s.ID, Kind: EventOnline, Time: t})
+	}
+	for _, s := range stored {
+		if a.isHubEntry(s) || seen[s.ID] || !online[s.ID] {
+			continue
 		}
+		events = append(events, ServerEvent{ServerID: s.ID, Kind: EventOffline, Time: t})
 	}
+	return events
+}
 
-	if len(update) > 0 {
-		if err := a.store.SaveServers(update); err != nil {
-			return err
+// Keeps the history of renamed servers, and of servers stored with their old
+// title only IDs (see makeID).
+// New servers with the same game url as an old one, or the same legacy ID,
+// takes over the old server's history and the old title is kept in the
+// FormerTitles. The stored entries are updated with the new IDs too.
+func (a *App) trackRenames(ctx context.Context, stored, current []ServerEntry) error {
+	known := make(map[string]int)
+	for i, s := range stored {
+		known[s.ID] = i
+	}
+	taken := make(map[string]bool)
+	for _, s := range current {
+		taken[s.ID] = true
+	}
+
+	for i, s := range current {
+		if a.isHubEntry(s) {
+			continue
+		}
+		if j, found := known[s.ID]; found {
+			current[i].FormerTitles = formerTitles(stored[j], s.Title)
+			continue
+		}
+
+		// Find the server's old entry, if there is one
+		j, found := known[legacyID(s.Title)]
+		if !found && s.GameURL != "" {
+			old, err := a.store.GetServerByGameURL(ctx, s.GameURL)
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+			j, found = known[old.ID]
+		}
+		if !found || taken[stored[j].ID] {
+			// A new server, or the old one is still around
+			continue
 		}
-		if err := a.updateHistory(t, update); err != nil {
+
+		old := stored[j]
+		if err := a.store.RenameServer(ctx, old.ID, s.ID); err != nil {
 			return err
 		}
+		if old.Title != s.Title {
+			a.log.Info("Server renamed", "id", s.ID, "old", old.Title, "new", s.Title)
+		}
+		taken[old.ID] = true
+		delete(known, old.ID)
+		known[s.ID] = j
+		stored[j].ID = s.ID
+		current[i].FormerTitles = formerTitles(old, s.Title)
 	}
 	return nil
 }
 
+// Returns the old server's FormerTitles, including its title if it's changed
+func formerTitles(old ServerEntry, title string) Titles {
+	titles := old.FormerTitles
+	if old.Title != title && !titles.Contains(old.Title) {
+		titles = append(titles, old.Title)
+	}
+	return titles
+}
+
+// Removes any stored servers that's too old and returns the rest of the
+// servers, missing from the current scrape, with their player count zeroed.
+func (a *App) updateOldServers(ctx context.Context, t time.Time, stored, current []ServerEntry) ([]ServerEntry, error) {
+	seen := make(map[string]bool)
+	for _, s := range current {
+		seen[s.ID] = true
+	}
+
+	var remove []ServerEntry
+	var update []ServerEntry
+	for _, s := range stored {
+		delta := t.Sub(s.LastSeenAt())
+		switch {
+		case seen[s.ID]:
+			continue
+		case delta > a.conf.OldServerTimeout:
+			remove = append(remove, s)
+		default:
+			s.Players = 0
+			update = append(update, s)
+		}
+	}
+
+	if len(remove) > 0 {
+		if err := a.store.RemoveServers(ctx, remove); err != nil {
+			return nil, err
+		}
+	}
+	return update, nil
+}
+
 func (a *App) makeHubEntry(t time.Time, servers []ServerEntry) ServerEntry {
 	var totalPlayers int
 	for _, s := range servers {
 		totalPlayers += s.Players
 	}
 
-	a.hub = ServerEntry{
-		ID:      makeID(internalServerTitle),
-		Title:   internalServerTitle,
+	hub := ServerEntry{
+		ID:      a.hubID(),
+		Title:   a.conf.InternalTitle,
 		SiteURL: "",
 		GameURL: "",
 		Time:    t,
 		Players: totalPlayers,
+
+		PeakPlayers: totalPlayers,
+		PeakTime:    t,
 	}
+
+	a.hubLock.Lock()
+	a.hub = hub
+	a.hubLock.Unlock()
+	return hub
+}
+
+// Returns the ID of the internal hub entry
+func (a *App) hubID() string {
+	return makeID(a.conf.InternalTitle, "")
+}
+
+// Returns true if s is the internal hub entry, which shouldn't be shown in
+// any server lists
+func (a *App) isHubEntry(s ServerEntry) bool {
+	return s.ID == a.hubID()
+}
+
+// Remove the internal entry used to count total players
+func (a *App) removeHubEntry(servers []ServerEntry) []ServerEntry {
+	var filtered []ServerEntry
+	for _, s := range servers {
+		if !a.isHubEntry(s) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// Returns true if the server is blocked by the Conf.BlockedServerIDs or
+// BlockedTitles
+func (a *App) isBlocked(s ServerEntry) bool {
+	if a.blocked[s.ID] {
+		return true
+	}
+	for _, re := range a.blockedRe {
+		if re.MatchString(s.Title) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the servers that aren't blocked (the hub entry never is)
+func (a *App) removeBlocked(servers []ServerEntry) []ServerEntry {
+	var filtered []ServerEntry
+	for _, s := range servers {
+		if a.isHubEntry(s) || !a.isBlocked(s) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// Returns a copy of the latest hub entry, safe for use by concurrent handlers
+func (a *App) getHub() ServerEntry {
+	a.hubLock.RLock()
+	defer a.hubLock.RUnlock()
 	return a.hub
 }
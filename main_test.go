@@ -0,0 +1,469 @@
+package ss13_se
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns an app using an open StorageMemory (unless c has another storage),
+// with the logs thrown away
+func newTestApp(t *testing.T, c Conf) *App {
+	t.Helper()
+	if c.Storage == nil {
+		store := NewStorageMemory()
+		if err := store.Open(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		c.Storage = store
+	}
+	if c.WebAddr == "" && !c.DisableWeb {
+		c.WebAddr = ":0"
+	}
+	if c.Logger == nil {
+		c.Logger = testLog
+	}
+	c.DisableAccessLog = true
+	a, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// Saves the servers like the updater does after a scrape, with the hub entry
+// and the last scrape stats
+func updateTestServers(a *App, now time.Time, servers ...ServerEntry) error {
+	list := make([]ServerEntry, len(servers))
+	for i, s := range servers {
+		s.Time = now
+		list[i] = s
+	}
+	hub := a.makeHubEntry(now, list)
+	list = append(list, hub)
+	if err := a.updateServers(context.Background(), now, list); err != nil {
+		return err
+	}
+	a.setLastScrape(scrapeStats{
+		TotalPlayers: hub.Players,
+		ServerCount:  len(list) - 1,
+		LastScrape:   now,
+	})
+	return nil
+}
+
+// Sends the request through the app's whole handler chain
+func serve(a *App, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	a.web.Handler.ServeHTTP(w, r)
+	return w
+}
+
+func get(a *App, target string) *httptest.ResponseRecorder {
+	return serve(a, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+// Answers every request with the same page, like a byond hub that never changes
+type hubTransport struct {
+	page []byte
+
+	lock     sync.Mutex
+	requests []*http.Request
+}
+
+func (h *hubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	h.lock.Lock()
+	h.requests = append(h.requests, r)
+	h.lock.Unlock()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       io.NopCloser(bytes.NewReader(h.page)),
+		Request:    r,
+	}, nil
+}
+
+// Returns a client that gets the testdata page for all hubs
+func testHubClient(t *testing.T, file string) (*http.Client, *hubTransport) {
+	t.Helper()
+	page, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &hubTransport{page: page}
+	return &http.Client{Transport: tr}, tr
+}
+
+// Meant to be run with -race, the updater and handlers share the hub entry,
+// the cached server list and the scrape stats
+func TestConcurrentReadsDuringUpdate(t *testing.T) {
+	client, _ := testHubClient(t, "testdata/hub.html")
+	a := newTestApp(t, Conf{HTTPClient: client})
+	ctx := context.Background()
+	if res := a.runUpdate(ctx, client); res.Error != "" {
+		t.Fatalf("first update failed: %s", res.Error)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			if res := a.runUpdate(ctx, client); res.Error != "" {
+				t.Errorf("update %d failed: %s", i, res.Error)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, target := range []string{"/", "/?q=station", "/api/servers", "/api/stats", "/server/hub"} {
+					if w := get(a, target); w.Code != http.StatusOK {
+						t.Errorf("GET %s: got status %d, want 200", target, w.Code)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := a.getHub().Players; got != 50 {
+		t.Errorf("got %d hub players, want 50", got)
+	}
+}
+
+func TestUpdateOldServers(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	timeouts := []time.Duration{0, 7 * 24 * time.Hour}
+	for _, timeout := range timeouts {
+		a := newTestApp(t, Conf{OldServerTimeout: timeout})
+		if timeout == 0 {
+			timeout = defaultOldServerTimeout
+		}
+		stored := []ServerEntry{
+			{ID: "old", Title: "Old Station", Players: 3, Time: now.Add(-timeout - time.Second)},
+			{ID: "recent", Title: "Recent Station", Players: 5, Time: now.Add(-timeout + time.Second)},
+			{ID: "current", Title: "Current Station", Players: 8, Time: now},
+		}
+		if err := a.store.SaveServers(ctx, stored); err != nil {
+			t.Fatal(err)
+		}
+		update, err := a.updateOldServers(ctx, now, stored, stored[2:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(update) != 1 || update[0].ID != "recent" || update[0].Players != 0 {
+			t.Errorf("timeout %s: got updated %+v, want only the recent server with 0 players", timeout, update)
+		}
+		if _, err := a.store.GetServer(ctx, "old"); err != ErrNotFound {
+			t.Errorf("timeout %s: got %v for the old server, want ErrNotFound", timeout, err)
+		}
+		for _, id := range []string{"recent", "current"} {
+			if _, err := a.store.GetServer(ctx, id); err != nil {
+				t.Errorf("timeout %s: got %v for the %s server, want it kept", timeout, err, id)
+			}
+		}
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	client, _ := testHubClient(t, "testdata/hub.html")
+	a := newTestApp(t, Conf{
+		Storage:    NewStorageMemory(),
+		WebAddr:    "127.0.0.1:0",
+		HTTPClient: client,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	// Lets the first scrape run, so the updater is waiting for the next one
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got error %q, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the context was cancelled")
+	}
+	if a.getHub().Players != 50 {
+		t.Errorf("got %d hub players, want the first scrape saved", a.getHub().Players)
+	}
+}
+
+func TestNewValidation(t *testing.T) {
+	store := NewStorageMemory()
+	tests := []struct {
+		conf Conf
+		want string
+	}{
+		{Conf{WebAddr: ":0"}, "conf: missing Storage"},
+		{Conf{Storage: store}, "conf: missing WebAddr"},
+		{Conf{Storage: store, WebAddr: ":0", ScrapeTimeout: time.Second}, "conf: ScrapeTimeout must be at least " + minScrapeTimeout.String()},
+		{Conf{Storage: store, DisableWeb: true, DisableScraper: true}, "conf: can't use both DisableWeb and DisableScraper"},
+		{Conf{Storage: store, WebAddr: ":0", TLSCertFile: "cert.pem"}, "conf: both TLSCertFile and TLSKeyFile must be set"},
+		{Conf{Storage: store, WebAddr: ":0", AdminUser: "admin"}, "conf: both AdminUser and AdminPassword must be set"},
+		{Conf{Storage: store, WebAddr: ":0", BasePath: "/ss13?x"}, "conf: BasePath can't have a query or fragment"},
+		{Conf{Storage: store, WebAddr: ":0", ScrapeJitter: 1}, "conf: ScrapeJitter must be between 0 and 1"},
+		{Conf{Storage: store, WebAddr: ":0", LogEveryNScrapes: -1}, "conf: LogEveryNScrapes can't be negative"},
+	}
+	for _, tt := range tests {
+		tt.conf.Logger = testLog
+		_, err := New(tt.conf)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("got error %v, want %q", err, tt.want)
+		}
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	if a.conf.ScrapeTimeout != defaultScrapeTimeout {
+		t.Errorf("got ScrapeTimeout %s, want %s", a.conf.ScrapeTimeout, defaultScrapeTimeout)
+	}
+	if a.conf.ReadTimeout != defaultReadTimeout || a.conf.WriteTimeout != defaultWriteTimeout {
+		t.Errorf("got timeouts %s and %s, want the defaults", a.conf.ReadTimeout, a.conf.WriteTimeout)
+	}
+	if a.conf.OldServerTimeout != defaultOldServerTimeout {
+		t.Errorf("got OldServerTimeout %s, want %s", a.conf.OldServerTimeout, defaultOldServerTimeout)
+	}
+}
+
+// Panics on the first few saves, like a storage with a bug on some bad data
+type panicStorage struct {
+	Storage
+	panics int
+}
+
+func (s *panicStorage) SaveServers(ctx context.Context, servers []ServerEntry) error {
+	if s.panics > 0 {
+		s.panics--
+		var e *ServerEntry
+		_ = e.Title // Nil deref
+	}
+	return s.Storage.SaveServers(ctx, servers)
+}
+
+func TestRunUpdateRecovers(t *testing.T) {
+	client, _ := testHubClient(t, "testdata/hub.html")
+	store := NewStorageMemory()
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestApp(t, Conf{Storage: &panicStorage{Storage: store, panics: 2}, HTTPClient: client})
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		res := a.runUpdate(ctx, client)
+		if !strings.HasPrefix(res.Error, "panic: ") {
+			t.Errorf("update %d: got error %q, want a recovered panic", i, res.Error)
+		}
+	}
+	if s := a.getUpdaterStatus(); s.Scrapes != 2 || s.LastFailure.IsZero() {
+		t.Errorf("got status %+v, want 2 failed scrapes", s)
+	}
+	if res := a.runUpdate(ctx, client); res.Error != "" {
+		t.Errorf("got error %q after the panics, want nil", res.Error)
+	}
+	if got := a.getHub().Players; got != 50 {
+		t.Errorf("got %d hub players, want 50", got)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	if a.webClient == nil || a.webClient.Timeout != 60*time.Second {
+		t.Errorf("got client %+v, want the default one", a.webClient)
+	}
+
+	client, tr := testHubClient(t, "testdata/hub.html")
+	a = newTestApp(t, Conf{HTTPClient: client, ProxyURL: "http://proxy.example.com:3128"})
+	if a.webClient != client {
+		t.Fatal("got another client, want the one from the conf")
+	}
+	if client.Transport != tr {
+		t.Error("got the transport replaced by the proxy, want the HTTPClient to take precedence")
+	}
+	if res := a.runUpdate(context.Background(), a.webClient); res.Error != "" {
+		t.Fatalf("got error %q", res.Error)
+	}
+	if len(tr.requests) < 1 {
+		t.Error("got no requests through the client")
+	}
+}
+
+func TestLegacyIDMigration(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	old := ServerEntry{ID: legacyID("Alpha Station"), Title: "Alpha Station", Players: 10}
+	if err := updateTestServers(a, now.Add(-time.Hour), old); err != nil {
+		t.Fatal(err)
+	}
+
+	gameURL := "byond://alpha.example.com:1337"
+	id := makeID("Alpha Station", gameURL)
+	current := ServerEntry{ID: id, Title: "Alpha Station", GameURL: gameURL, Players: 12}
+	if err := updateTestServers(a, now, current); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.store.GetServer(ctx, old.ID); err != ErrNotFound {
+		t.Errorf("got %v for the legacy ID, want ErrNotFound", err)
+	}
+	points, err := a.store.GetServerHistoryRange(ctx, id, now.Add(-2*time.Hour), now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Errorf("got %d points for the new ID, want the old history kept", len(points))
+	}
+}
+
+func TestBlockedServers(t *testing.T) {
+	ctx := context.Background()
+	client, _ := testHubClient(t, "testdata/hub.html")
+	a := newTestApp(t, Conf{HTTPClient: client})
+	if res := a.runUpdate(ctx, client); res.Error != "" {
+		t.Fatalf("got error %q", res.Error)
+	}
+	servers, err := a.store.GetServers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var alphaID string
+	for _, s := range servers {
+		if s.Title == "Alpha Station" {
+			alphaID = s.ID
+		}
+	}
+	if alphaID == "" {
+		t.Fatal("Alpha Station wasn't saved")
+	}
+
+	// Blocked later on, so the old entries must be purged too
+	a = newTestApp(t, Conf{
+		Storage:          a.store,
+		HTTPClient:       client,
+		BlockedServerIDs: []string{alphaID},
+		BlockedTitles:    []string{`(?i)^beta\b`},
+	})
+	if res := a.runUpdate(ctx, client); res.Error != "" {
+		t.Fatalf("got error %q", res.Error)
+	}
+	servers, err = a.store.GetServers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		if s.Title == "Alpha Station" || s.Title == "Beta Station" {
+			t.Errorf("got blocked server %q in the storage", s.Title)
+		}
+	}
+	points, err := a.store.GetSingleServerHistory(ctx, alphaID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) > 0 {
+		t.Errorf("got %d history points for a blocked server, want them removed", len(points))
+	}
+	for _, s := range getServersJSON(t, a, "/api/servers") {
+		if s.Title == "Alpha Station" || s.Title == "Beta Station" {
+			t.Errorf("got blocked server %q in the API", s.Title)
+		}
+	}
+	if got := a.getHub().Players; got != 1 {
+		t.Errorf("got %d hub players, want only the unblocked ones", got)
+	}
+}
+
+func TestUpdateSameScrapeTwice(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	now := time.Now().Truncate(time.Second)
+	for i := 0; i < 2; i++ {
+		if err := updateTestServers(a, now, testServers()...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	points, err := a.store.GetServerHistory(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]int)
+	for _, p := range points {
+		seen[p.ServerID]++
+	}
+	// The 3 servers and the hub entry
+	if len(seen) != 4 {
+		t.Errorf("got points for %d servers, want 4", len(seen))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("got %d points for %s, want 1", n, id)
+		}
+	}
+}
+
+// Two servers can have the same title, but they're only the same server if
+// they share the game url too
+func TestUpdateSameTitles(t *testing.T) {
+	page := `<div class="live_game_entry"><div class="live_game_status">
+		<b>Space Station 13</b>
+		<br/><span class="smaller"><nobr>byond://one.example.com:1337</nobr></span>
+		<br/><br/>Logged in: 12 players
+	</div></div>
+	<div class="live_game_entry"><div class="live_game_status">
+		<b>Space Station 13</b>
+		<br/><span class="smaller"><nobr>byond://two.example.com:1337</nobr></span>
+		<br/><br/>Logged in: 3 players
+	</div></div>`
+	client := &http.Client{Transport: &hubTransport{page: []byte(page)}}
+	a := newTestApp(t, Conf{HTTPClient: client})
+	ctx := context.Background()
+	if res := a.runUpdate(ctx, client); res.Error != "" {
+		t.Fatalf("got error %q", res.Error)
+	}
+
+	servers, err := a.store.GetServers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]int)
+	for _, s := range servers {
+		if s.Title == "Space Station 13" {
+			ids[s.ID] = s.Players
+		}
+	}
+	if len(ids) != 2 {
+		t.Fatalf("got %d servers with the same title, want 2", len(ids))
+	}
+	one := makeID("Space Station 13", "byond://one.example.com:1337")
+	two := makeID("Space Station 13", "byond://two.example.com:1337")
+	if ids[one] != 12 || ids[two] != 3 {
+		t.Errorf("got %v, want both servers with their own players", ids)
+	}
+}
@@ -0,0 +1,77 @@
+package ss13_se
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	scrapes        prometheus.Counter
+	scrapeErrors   prometheus.Counter
+	scrapeDuration prometheus.Histogram
+	servers        prometheus.Gauge
+	players        prometheus.Gauge
+	storageWrites  *prometheus.HistogramVec
+	historyPoints  prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		scrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ss13se_scrape_total",
+			Help: "Total number of scrape cycles.",
+		}),
+		scrapeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ss13se_scrape_errors_total",
+			Help: "Total number of failed scrape cycles.",
+		}),
+		scrapeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ss13se_scrape_duration_seconds",
+			Help:    "Duration of scrape cycles, including any retries.",
+			Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		}),
+		servers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ss13se_servers_current",
+			Help: "Number of servers found in the latest scrape.",
+		}),
+		players: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ss13se_total_players",
+			Help: "Total number of players found in the latest scrape.",
+		}),
+		storageWrites: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ss13se_storage_write_seconds",
+			Help:    "Duration of the writes of servers and history to the storage.",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		}, []string{"op"}),
+		historyPoints: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ss13se_history_points",
+			Help: "Number of history points in the storage, as of the latest retention run.",
+		}),
+	}
+	// Shows both ops from the start, instead of after their first writes
+	m.storageWrites.WithLabelValues("servers")
+	m.storageWrites.WithLabelValues("history")
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.scrapes,
+		m.scrapeErrors,
+		m.scrapeDuration,
+		m.servers,
+		m.players,
+		m.storageWrites,
+		m.historyPoints,
+	)
+	return m
+}
+
+// Observes the duration of a storage write since start, meant to be deferred
+// like: defer a.metrics.observeWrite("history", time.Now())
+func (m *metrics) observeWrite(op string, start time.Time) {
+	m.storageWrites.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,73 @@
+package ss13_se
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Returns the number of observations of the storage write histogram for op
+func writeCount(t *testing.T, reg prometheus.Gatherer, op string) uint64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "ss13se_storage_write_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "op" && l.GetValue() == op {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	t.Fatalf("found no storage writes for %q", op)
+	return 0
+}
+
+func gaugeValue(t *testing.T, reg prometheus.Gatherer, name string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == name && len(f.GetMetric()) > 0 {
+			return f.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("found no gauge %q", name)
+	return 0
+}
+
+func TestStorageWriteMetrics(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	reg := a.metrics.registry
+	for _, op := range []string{"servers", "history"} {
+		if n := writeCount(t, reg, op); n != 0 {
+			t.Errorf("got %d %s writes before any updates, want 0", n, op)
+		}
+	}
+
+	now := time.Now()
+	if err := updateTestServers(a, now, testServers()...); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"servers", "history"} {
+		if n := writeCount(t, reg, op); n != 1 {
+			t.Errorf("got %d %s writes after an update, want 1", n, op)
+		}
+	}
+
+	a.runRetention(context.Background(), now)
+	// The 3 servers and the hub entry
+	if got := gaugeValue(t, reg, "ss13se_history_points"); got != 4 {
+		t.Errorf("got %v history points, want 4", got)
+	}
+}
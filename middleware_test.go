@@ -0,0 +1,157 @@
+package ss13_se
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipHandler(t *testing.T) {
+	large := strings.Repeat("ss13 ", gzipMinSize)
+	tests := []struct {
+		name        string
+		encoding    string
+		contentType string
+		status      int
+		body        string
+		want        bool
+	}{
+		{"large", "gzip, deflate", "text/html", 200, large, true},
+		{"sniffed type", "gzip", "", 200, large, true},
+		{"svg", "gzip", "image/svg+xml", 200, large, true},
+		{"no support", "", "text/html", 200, large, false},
+		{"tiny", "gzip", "text/html", 200, "ss13", false},
+		{"png", "gzip", "image/png", 200, large, false},
+	}
+	for _, tt := range tests {
+		h := gzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.contentType != "" {
+				w.Header().Set("Content-Type", tt.contentType)
+			}
+			w.WriteHeader(tt.status)
+			// Split up, so the buffering is tested too
+			io.WriteString(w, tt.body[:len(tt.body)/2])
+			io.WriteString(w, tt.body[len(tt.body)/2:])
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.encoding != "" {
+			r.Header.Set("Accept-Encoding", tt.encoding)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%s: got Vary %q, want Accept-Encoding", tt.name, got)
+		}
+		gzipped := w.Header().Get("Content-Encoding") == "gzip"
+		if gzipped != tt.want {
+			t.Errorf("%s: got gzipped %v, want %v", tt.name, gzipped, tt.want)
+			continue
+		}
+
+		body := w.Body.String()
+		if gzipped {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			b, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			body = string(b)
+		}
+		if body != tt.body {
+			t.Errorf("%s: got a body of %d bytes, want %d", tt.name, len(body), len(tt.body))
+		}
+	}
+}
+
+func TestGzipResponses(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := serve(a, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("got status %d and encoding %q for the index, want it gzipped",
+			w.Code, w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestRecoverHandler(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	h := a.recoverHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s *ServerEntry
+		io.WriteString(w, s.Title)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/server/broken", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want 500", w.Code)
+	}
+
+	// The aborts are passed on to net/http
+	h = a.recoverHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("got panic %v, want http.ErrAbortHandler", p)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestCORS(t *testing.T) {
+	a := newTestApp(t, Conf{AllowedOrigins: []string{"https://app.example.com"}})
+	tests := []struct {
+		method string
+		target string
+		origin string
+		want   int
+		allow  string
+	}{
+		{"GET", "/api/servers", "https://app.example.com", 200, "https://app.example.com"},
+		{"GET", "/api/servers", "https://APP.example.com", 200, "https://APP.example.com"},
+		{"GET", "/api/servers", "https://evil.example.com", 200, ""},
+		{"GET", "/api/servers", "", 200, ""},
+		{"OPTIONS", "/api/servers", "https://app.example.com", 204, "https://app.example.com"},
+		{"OPTIONS", "/api/servers", "https://evil.example.com", 204, ""},
+		{"GET", "/", "https://app.example.com", 200, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		w := serve(a, r)
+		if w.Code != tt.want {
+			t.Errorf("%s %s from %q: got status %d, want %d", tt.method, tt.target, tt.origin, w.Code, tt.want)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allow {
+			t.Errorf("%s %s from %q: got allowed origin %q, want %q", tt.method, tt.target, tt.origin, got, tt.allow)
+		}
+		methods := w.Header().Get("Access-Control-Allow-Methods")
+		if preflight := tt.method == "OPTIONS" && tt.allow != ""; preflight != (methods != "") {
+			t.Errorf("%s %s from %q: got allowed methods %q", tt.method, tt.target, tt.origin, methods)
+		}
+	}
+}
+
+func TestCORSDefault(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	r := httptest.NewRequest("GET", "/api/servers", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	if got := serve(a, r).Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("got allowed origin %q, want none by default", got)
+	}
+}
@@ -0,0 +1,105 @@
+package ss13_se
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default for Conf.RateLimitBurst
+	defaultRateLimitBurst = 10
+	// How often the limiter drops the buckets of idle clients
+	rateLimitCleanup = time.Minute
+)
+
+// Token bucket rate limiter, keyed by client IP
+type rateLimiter struct {
+	rate  float64 // Tokens added per second
+	burst float64 // Max tokens in a bucket
+
+	lock        sync.Mutex
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Takes a token from the client's bucket, or returns false and how long until
+// the next one is available if it's empty.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.lastCleanup) > rateLimitCleanup {
+		l.cleanup(now)
+	}
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Drops all buckets that would have been refilled by now anyway, so only the
+// recently active clients are kept in memory
+func (l *rateLimiter) cleanup(now time.Time) {
+	l.lastCleanup = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Responds with a 429 to clients sending requests too fast
+func (a *App) rateLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := a.limiter.allow(clientIP(r, a.conf.TrustProxyHeaders), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the IP of the client, from the last X-Forwarded-For entry if
+// trustProxy is set (the one added by the proxy itself)
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		parts := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,196 @@
+package ss13_se
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// A route served by the web server. The API routes are also described by the
+// /api index, so keep their docs up to date.
+type route struct {
+	Path    string
+	Handler http.Handler
+
+	API         bool
+	Methods     []string
+	Description string
+	Params      []routeParam
+}
+
+// A query param taken by an API route
+type routeParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// All routes, in the order they're registered
+func (a *App) routes() []route {
+	api := func(fn handler) http.Handler {
+		return a.corsHandler(apiHandler(fn))
+	}
+	// All /admin routes must use this
+	admin := func(fn handler) http.Handler {
+		return a.adminHandler(apiHandler(fn))
+	}
+	get := []string{http.MethodGet}
+	rangeParams := []routeParam{
+		{"from", "Start of the history, RFC3339 (defaults to 24 hours before to)"},
+		{"to", "End of the history, RFC3339 (defaults to now)"},
+		{"limit", "Max number of points, keeping the most recent ones"},
+	}
+	return []route{
+		{Path: "/", Handler: handler(a.pageIndex)},
+		{Path: "/static/style.css", Handler: handler(a.pageStyle)},
+		{Path: "/favicon.ico", Handler: handler(a.pageFavicon)},
+		{Path: "/robots.txt", Handler: handler(a.pageRobots)},
+		{Path: "/server/{id}", Handler: handler(a.pageServer)},
+		{Path: "/server/{id}/daily", Handler: handler(a.pageDailyChart)},
+		{Path: "/server/{id}/weekly", Handler: handler(a.pageWeeklyChart)},
+		{Path: "/server/{id}/monthly", Handler: handler(a.pageMonthlyChart)},
+		{Path: "/server/{id}/averagedaily", Handler: handler(a.pageAverageDailyChart)},
+		{Path: "/server/{id}/averagehourly", Handler: handler(a.pageAverageHourlyChart)},
+		{Path: "/server/{id}/heatmap", Handler: handler(a.pageHeatmap)},
+		{Path: "/server/{id}/history.csv", Handler: handler(a.pageHistoryCSV)},
+		{Path: "/server/{id}/favorite", Handler: handler(a.pageToggleFavorite)},
+		{Path: "/server/{id}/embed", Handler: handler(a.pageEmbed)},
+		{
+			Path:        "/server/{id}/history.json",
+			Handler:     api(a.apiHistoryBuckets),
+			API:         true,
+			Methods:     get,
+			Description: "Average, peak and 25th/75th percentile of the players per hour or weekday, during the last 30 days",
+			Params: []routeParam{
+				{"bucket", `How to group the history, "hour" (default) or "day"`},
+				{"tz", `Timezone of the buckets, an IANA name like "Europe/Stockholm"`},
+			},
+		},
+		{Path: "/compare", Handler: handler(a.pageCompareChart)},
+		{Path: "/leaderboard", Handler: handler(a.pageLeaderboard)},
+		{Path: "/favorites", Handler: handler(a.pageFavorites)},
+		{Path: "/stats", Handler: handler(a.pageStats)},
+		{Path: "/stats/history", Handler: handler(a.pageStatsChart)},
+		{Path: "/feed.xml", Handler: handler(a.pageFeed)},
+		{Path: "/sitemap.xml", Handler: handler(a.pageSitemap)},
+		{
+			Path:        "/api",
+			Handler:     api(a.apiIndex),
+			API:         true,
+			Methods:     get,
+			Description: "Lists all API routes",
+		},
+		{
+			Path:        "/api/servers",
+			Handler:     api(a.apiServers),
+			API:         true,
+			Methods:     get,
+			Description: "All known servers",
+			Params: []routeParam{
+				{"sort", `Sort by "players" (default) or "title", prefix with "-" to reverse`},
+				{"includeHub", `Set to "true" to include the global stats entry`},
+				{"minPlayers", "Only include servers with at least this many players"},
+			},
+		},
+		{
+			Path:        "/api/servers/{id}/history",
+			Handler:     api(a.apiServerHistory),
+			API:         true,
+			Methods:     get,
+			Description: "Player history of a server, with the newest first",
+			Params:      rangeParams,
+		},
+		{
+			Path:        "/api/stats",
+			Handler:     api(a.apiStats),
+			API:         true,
+			Methods:     get,
+			Description: "Total players and servers from the last scrape",
+		},
+		{
+			Path:        "/api/storage",
+			Handler:     api(a.apiStorage),
+			API:         true,
+			Methods:     get,
+			Description: "Number of servers and history points in the database, with its approximate size",
+		},
+		{
+			Path:        "/api/leaderboard",
+			Handler:     api(a.apiLeaderboard),
+			API:         true,
+			Methods:     get,
+			Description: "Top servers during the last few days",
+			Params: []routeParam{
+				{"metric", `Rank by "average" (default) or "peak" players, or by "playerhours" per day (estimated from the history)`},
+				{"days", "Number of days, between 1 and 365 (or 30 for playerhours, defaults to 7)"},
+				{"limit", "Max number of servers"},
+			},
+		},
+		{Path: "/healthz", Handler: handler(a.pageHealth)},
+		{Path: "/admin/scrape", Handler: admin(a.apiAdminScrape)},
+		{Path: "/admin/status", Handler: admin(a.apiAdminStatus)},
+		{Path: "/metrics", Handler: promhttp.HandlerFor(a.metrics.registry, promhttp.HandlerOpts{})},
+	}
+}
+
+func (a *App) newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(a.hubAliasHandler, a.basePathHandler)
+	base := a.conf.BasePath
+	if base != "" {
+		// The index is at "/ss13/", but the proxies might send "/ss13" too
+		r.Handle(base, http.RedirectHandler(base+"/", http.StatusMovedPermanently))
+	}
+	for _, rt := range a.routeTable {
+		h := r.Handle(base+rt.Path, rt.Handler)
+		if len(rt.Methods) > 0 {
+			// Other methods gets a 405 from the router
+			h.Methods(routeMethods(rt)...)
+		}
+	}
+	return r
+}
+
+// Returns the methods a route is registered with. GET routes also takes HEAD,
+// and the API routes must take OPTIONS for the CORS preflights.
+func routeMethods(rt route) []string {
+	var methods []string
+	for _, m := range rt.Methods {
+		methods = append(methods, m)
+		if m == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	if rt.API {
+		methods = append(methods, http.MethodOptions)
+	}
+	return methods
+}
+
+type apiRoute struct {
+	Path        string       `json:"path"`
+	Methods     []string     `json:"methods"`
+	Description string       `json:"description"`
+	Params      []routeParam `json:"params"`
+}
+
+// Describes the API routes, generated from the route table
+func (a *App) apiIndex(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	list := []apiRoute{}
+	for _, rt := range a.routeTable {
+		if !rt.API {
+			continue
+		}
+		params := rt.Params
+		if params == nil {
+			params = []routeParam{}
+		}
+		list = append(list, apiRoute{
+			Path:        a.conf.BasePath + rt.Path,
+			Methods:     rt.Methods,
+			Description: rt.Description,
+			Params:      params,
+		})
+	}
+	return writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,98 @@
+package ss13_se
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBasePath(t *testing.T) {
+	for _, base := range []string{"/ss13", "/ss13/", "ss13"} {
+		a := newTestApp(t, Conf{BasePath: base})
+		if a.conf.BasePath != "/ss13" {
+			t.Errorf("%q: got base path %q, want /ss13", base, a.conf.BasePath)
+		}
+		if err := updateTestServers(a, time.Now(), testServers()...); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			target string
+			status int
+		}{
+			{"/ss13/", http.StatusOK},
+			{"/ss13", http.StatusMovedPermanently},
+			{"/ss13/server/a", http.StatusOK},
+			{"/ss13/server/a/daily", http.StatusOK},
+			{"/ss13/api/servers", http.StatusOK},
+			{"/ss13/static/style.css", http.StatusOK},
+			{"/", http.StatusNotFound},
+			{"/server/a", http.StatusNotFound},
+		}
+		for _, tt := range tests {
+			if w := get(a, tt.target); w.Code != tt.status {
+				t.Errorf("%q: GET %s: got status %d, want %d", base, tt.target, w.Code, tt.status)
+			}
+		}
+		if loc := get(a, "/ss13").Header().Get("Location"); loc != "/ss13/" {
+			t.Errorf("%q: got redirect to %q, want /ss13/", base, loc)
+		}
+
+		body := get(a, "/ss13/").Body.String()
+		for _, link := range []string{`href="/ss13/static/style.css"`, `href="/ss13/server/a"`, `href="/ss13/server/hub"`} {
+			if !strings.Contains(body, link) {
+				t.Errorf("%q: index is missing the link %s", base, link)
+			}
+		}
+		if strings.Contains(body, `href="/server/`) {
+			t.Errorf("%q: index has links without the base path", base)
+		}
+		if body := get(a, "/ss13/robots.txt").Body.String(); !strings.Contains(body, "Disallow: /ss13/") {
+			t.Errorf("%q: got robots.txt %q, want the base path", base, body)
+		}
+	}
+}
+
+func TestNoBasePath(t *testing.T) {
+	a := newTestApp(t, Conf{})
+	if err := updateTestServers(a, time.Now(), testServers()...); err != nil {
+		t.Fatal(err)
+	}
+	body := get(a, "/").Body.String()
+	if !strings.Contains(body, `href="/server/a"`) || !strings.Contains(body, `href="/static/style.css"`) {
+		t.Error("index is missing the links from the root")
+	}
+}
+
+func TestRouteMethods(t *testing.T) {
+	a := newTestApp(t, Conf{AllowedOrigins: []string{"*"}})
+	if err := updateTestServers(a, time.Now(), testServers()...); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		status int
+	}{
+		{"GET", "/api/servers", http.StatusOK},
+		{"HEAD", "/api/servers", http.StatusOK},
+		{"POST", "/api/servers", http.StatusMethodNotAllowed},
+		{"DELETE", "/api/stats", http.StatusMethodNotAllowed},
+		{"POST", "/server/a/history.json", http.StatusMethodNotAllowed},
+		{"OPTIONS", "/api/servers", http.StatusNoContent},
+		{"OPTIONS", "/server/a/history.json", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.method == "OPTIONS" {
+			r.Header.Set("Origin", "https://app.example.com")
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		if w := serve(a, r); w.Code != tt.status {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.target, w.Code, tt.status)
+		}
+	}
+}
@@ -1,15 +1,20 @@
 package ss13_se
 
 import (
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"html"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
@@ -18,27 +23,123 @@ import (
 )
 
 const (
-	byondURL string = "http://www.byond.com/games/Exadv1/SpaceStation13"
-	//byondURL  string = "./tmp/dump.html" // For testing
-	userAgent string = "ss13hub/2.0pre"
+	byondURL string = "http://www.byond.com/games/"
+	//byondURL  string = "./tmp/" // For testing, with dumps like ./tmp/Exadv1/SpaceStation13
+	// Default for Conf.HubSources
+	defaultHubSource string = "Exadv1/SpaceStation13"
+	// Default for Conf.ScrapeUserAgent
+	userAgent string = "ss13hub/2.0pre (+https://www.ss13.se/)"
 )
 
 var (
 	rePlayers = regexp.MustCompile(`Logged in: (\d+) player`)
 	//rePlayers = regexp.MustCompile(`<br/>\s*<br/>\s*Logged in: (\d+) player.*<a href`)
+
+	// Used for parsing the free form status text, that each server sets
+	// themselves, so these are just best guesses of common formats
+	reLineBreak = regexp.MustCompile(`(?i)<br\s*/?>`)
+	reTags      = regexp.MustCompile(`<[^>]*>`)
+	reVersion   = regexp.MustCompile(`(?i)\bversion:\s*([^,;|]+)`)
+	reMap       = regexp.MustCompile(`(?i)\bmap:\s*([^,;|]+)`)
+	reRoundTime = regexp.MustCompile(`(?i)\b(?:round\s*)?(?:time|duration):\s*(\d+):(\d{2})(?::(\d{2}))?`)
 )
 
-func scrapeByond(webClient *http.Client, now time.Time) ([]ServerEntry, error) {
+// Returned together with the servers that could be scraped, when some of the
+// hubs or server entries couldn't be.
+type partialScrapeError struct {
+	Errs []error
+}
+
+func (e partialScrapeError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("partial scrape, %d errors: %s", len(e.Errs), strings.Join(msgs, "; "))
+}
+
+func (e partialScrapeError) Unwrap() []error {
+	return e.Errs
+}
+
+// Returned when a hub page doesn't look like one at all, which most likely
+// means byond has changed the page (or sent something else, like a captcha)
+// and the parser must be updated
+type hubFormatError struct {
+	Title   string // Of the page, as a hint of what it was
+	Entries int    // Found, but none of them could be parsed
+	Failed  int
+}
+
+func (e hubFormatError) Error() string {
+	if e.Entries < 1 {
+		return fmt.Sprintf("unrecognized hub page format, no server entries found (page title: %q)", e.Title)
+	}
+	return fmt.Sprintf("unrecognized hub page format, all %d server entries failed to parse", e.Failed)
+}
+
+// Scrapes the hub pages of each of the sources (like "Exadv1/SpaceStation13")
+// in order, tagging the servers with the source they was found in.
+//
+// The error is fatal, with no servers returned, only if none of the hubs could
+// be scraped. Otherwise it's a partialScrapeError (if anything failed) and the
+// servers are good to be saved. A hub page without a single parseable entry
+// counts as a failed hub, with a hubFormatError.
+func scrapeByond(ctx context.Context, log *slog.Logger, webClient *http.Client, ua string, sources []string, now time.Time) ([]ServerEntry, error) {
+	var servers []ServerEntry
+	var errs []error
+	ok := 0
+	for _, source := range sources {
+		list, err := scrapeHub(ctx, webClient, ua, source, now)
+		var partial partialScrapeError
+		var format hubFormatError
+		if errors.As(err, &partial) && len(list) > 0 {
+			log.Warn("Skipped unparseable entries on hub", "hub", source, "skipped", len(partial.Errs), "servers", len(list))
+			errs = append(errs, partial.Errs...)
+		} else if errors.As(err, &format) {
+			// Keeps going like any other failed hub, but loud enough to be
+			// noticed before the history dries up
+			log.Error("Hub page format not recognized, the parser probably needs updating", "hub", source, "err", err)
+			errs = append(errs, fmt.Errorf("hub %s: %w", source, err))
+			continue
+		} else if err != nil {
+			log.Warn("Error scraping hub", "hub", source, "err", err)
+			errs = append(errs, fmt.Errorf("hub %s: %w", source, err))
+			continue
+		}
+		if len(list) < 1 {
+			// Could be a quiet hub, but also a format change that the checks
+			// above didn't catch
+			log.Warn("No servers with players found on hub", "hub", source)
+		}
+		ok++
+		for i := range list {
+			list[i].Source = source
+		}
+		servers = append(servers, list...)
+	}
+
+	switch {
+	case ok == 0 && len(errs) > 0:
+		// Keeps the first error as it is, so the rate limits can be found
+		return nil, errs[0]
+	case len(errs) > 0:
+		return servers, partialScrapeError{Errs: errs}
+	}
+	return servers, nil
+}
+
+func scrapeHub(ctx context.Context, webClient *http.Client, ua string, source string, now time.Time) ([]ServerEntry, error) {
 	var body io.ReadCloser
-	if byondURL == "./tmp/dump.html" {
-		r, err := os.Open(byondURL)
+	if !strings.HasPrefix(byondURL, "http") {
+		r, err := os.Open(byondURL + source)
 		if err != nil {
 			return nil, err
 		}
 		body = r
 	} else {
 
-		r, err := openPage(webClient, byondURL)
+		r, err := openPage(ctx, webClient, ua, byondURL+source)
 		if err != nil {
 			return nil, err
 		}
@@ -46,32 +147,91 @@ func scrapeByond(webClient *http.Client, now time.Time) ([]ServerEntry, error) {
 	}
 	defer body.Close()
 
-	servers, err := parseByondPage(now, body)
-	if err != nil {
-		return nil, err
+	// Might return a partialScrapeError, with the servers that could be parsed
+	return parseByondPage(now, body)
+}
+
+// Returned when byond is throttling us, with a "429 Too Many Requests"
+type rateLimitError struct {
+	// From the Retry-After header, zero if it was missing or invalid
+	RetryAfter time.Duration
+}
+
+func (e rateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
 	}
+	return "rate limited"
+}
 
-	return servers, nil
+// Parses a Retry-After header, which is either in seconds or a http date
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	h = strings.TrimSpace(h)
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
 }
 
-func openPage(webClient *http.Client, url string) (io.ReadCloser, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func openPage(ctx context.Context, webClient *http.Client, ua, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("User-Agent", userAgent)
+	req.Header.Set("User-Agent", ua)
 
 	resp, err := webClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		resp.Body.Close()
+		return nil, rateLimitError{
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return nil, fmt.Errorf("bad http.Response.Status: %s", resp.Status)
 	}
 	return resp.Body, nil
 }
 
+// Runs fn for each index from 0 to count, with at most n running at the same
+// time. Returns when all of them are done.
+// fn should store its result by the index, so the order is kept.
+func runWorkers(n, count int, fn func(i int)) {
+	if n < 1 {
+		n = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < n && w < count; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
 func parseByondPage(now time.Time, body io.Reader) ([]ServerEntry, error) {
 	// Yep, Byond serves it's pages with Windows-1252 encoding...
 	r := charmap.Windows1252.NewDecoder().Reader(body)
@@ -80,11 +240,17 @@ func parseByondPage(now time.Time, body io.Reader) ([]ServerEntry, error) {
 		return nil, err
 	}
 
+	entries := doc.Find(".live_game_entry")
+	if entries.Length() < 1 {
+		return nil, hubFormatError{Title: strings.TrimSpace(doc.Find("title").First().Text())}
+	}
+
 	var servers []ServerEntry
-	doc.Find(".live_game_entry").Each(func(i int, s *goquery.Selection) {
-		entry, err := parseEntry(s.Find(".live_game_status"))
+	var errs []error
+	entries.Each(func(i int, s *goquery.Selection) {
+		entry, err := parseEntrySafe(s.Find(".live_game_status"))
 		if err != nil {
-			log.Println("Error parsing entry:", err)
+			errs = append(errs, fmt.Errorf("entry %d: %w", i, err))
 			return
 		}
 		if entry.IsZero() {
@@ -102,12 +268,31 @@ func parseByondPage(now time.Time, body io.Reader) ([]ServerEntry, error) {
 		}
 
 		entry.Time = now
+		entry.PeakPlayers = entry.Players
+		entry.PeakTime = now
 		servers = append(servers, entry)
 	})
 
+	switch {
+	case len(servers) < 1 && len(errs) > 0:
+		return nil, hubFormatError{Entries: entries.Length(), Failed: len(errs)}
+	case len(errs) > 0:
+		return servers, partialScrapeError{Errs: errs}
+	}
 	return servers, nil
 }
 
+// Like parseEntry, but a panic from a weird entry is returned as an error,
+// so it only skips that entry instead of failing the whole page
+func parseEntrySafe(s *goquery.Selection) (entry ServerEntry, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while parsing: %v", r)
+		}
+	}()
+	return parseEntry(s)
+}
+
 func parseEntry(s *goquery.Selection) (ServerEntry, error) {
 	// Try find a player count (really tricky since it's not in a valid
 	// html tag by itself)
@@ -135,23 +320,216 @@ func parseEntry(s *goquery.Selection) (ServerEntry, error) {
 		// blank, no server name or player count (just some byond url)
 		return ServerEntry{}, nil
 	}
-	id := makeID(title)
-
-	gameURL := s.Find("span.smaller").Find("nobr").Text()
+	gameURL := strings.TrimSpace(s.Find("span.smaller").Find("nobr").Text())
+	// Made from the url as it's shown on the hub, so the IDs doesn't change
+	// whenever the normalizing does
+	id := makeID(title, gameURL)
 	siteURL := s.Find("a").First().AttrOr("href", "")
-	if siteURL == "http://" {
-		siteURL = ""
-	}
 
-	return ServerEntry{
+	entry := ServerEntry{
 		ID:      id,
 		Title:   title,
-		SiteURL: siteURL,
-		GameURL: gameURL,
+		SiteURL: normalizeSiteURL(siteURL),
+		GameURL: normalizeGameURL(gameURL),
 		Players: players,
-	}, nil
+	}
+	parseStatus(s, &entry)
+	return entry, nil
+}
+
+// Tries to find any extra server info in the status text. Anything missing or
+// unparseable is left empty.
+func parseStatus(s *goquery.Selection, entry *ServerEntry) {
+	raw, err := s.Html()
+	if err != nil {
+		return
+	}
+
+	for _, line := range reLineBreak.Split(raw, -1) {
+		line = strings.TrimSpace(html.UnescapeString(reTags.ReplaceAllString(line, "")))
+		if r := reVersion.FindStringSubmatch(line); r != nil && entry.Version == "" {
+			entry.Version = strings.TrimSpace(r[1])
+		}
+		if r := reMap.FindStringSubmatch(line); r != nil && entry.Map == "" {
+			entry.Map = strings.TrimSpace(r[1])
+		}
+		if r := reRoundTime.FindStringSubmatch(line); r != nil && entry.RoundDuration == 0 {
+			entry.RoundDuration = parseRoundTime(r[1:])
+		}
+	}
+}
+
+// Parses "hh:mm" or "hh:mm:ss" parts, as matched by reRoundTime
+func parseRoundTime(parts []string) time.Duration {
+	units := []time.Duration{time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, p := range parts {
+		if p == "" {
+			continue
+		}
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return 0
+		}
+		d += time.Duration(v) * units[i]
+	}
+	return d
+}
+
+type DedupeKey string
+
+const (
+	DedupeByTitle   DedupeKey = "title"
+	DedupeByGameURL DedupeKey = "gameurl"
+)
+
+// Collapses servers sharing the same key, keeping the one with the most players
+// and filling in any of it's missing info from the duplicates.
+// Servers with an empty key are always kept. An empty DedupeKey uses the game
+// url, or the title for the servers without one, the same way the IDs are made
+// (see makeID), so distinct servers are never collapsed just by their titles.
+// Servers sharing an ID are always collapsed too, as they would only overwrite
+// each other when saved.
+func dedupeServers(servers []ServerEntry, key DedupeKey) []ServerEntry {
+	// Normalized again, so the servers that aren't from the scraper are
+	// compared the same way
+	gameURL := func(s ServerEntry) string {
+		return strings.ToLower(normalizeGameURL(s.GameURL))
+	}
+	keyOf := func(s ServerEntry) string {
+		switch key {
+		case DedupeByTitle:
+			return s.Title
+		case DedupeByGameURL:
+			return gameURL(s)
+		}
+		if u := gameURL(s); u != "" {
+			return "url:" + u
+		}
+		return "title:" + s.Title
+	}
+	servers = collapseServers(servers, keyOf)
+	return collapseServers(servers, func(s ServerEntry) string {
+		return s.ID
+	})
+}
+
+func collapseServers(servers []ServerEntry, keyOf func(ServerEntry) string) []ServerEntry {
+	var deduped []ServerEntry
+	index := make(map[string]int)
+	for _, s := range servers {
+		k := keyOf(s)
+		i, found := index[k]
+		if k == "" {
+			deduped = append(deduped, s)
+			continue
+		} else if !found {
+			index[k] = len(deduped)
+			deduped = append(deduped, s)
+			continue
+		}
+
+		best, other := deduped[i], s
+		if other.Players > best.Players {
+			best, other = other, best
+		}
+		if best.SiteURL == "" {
+			best.SiteURL = other.SiteURL
+		}
+		if best.GameURL == "" {
+			best.GameURL = other.GameURL
+		}
+		if best.Version == "" {
+			best.Version = other.Version
+		}
+		if best.Map == "" {
+			best.Map = other.Map
+		}
+		if best.RoundDuration == 0 {
+			best.RoundDuration = other.RoundDuration
+		}
+		deduped[i] = best
+	}
+	return deduped
+}
+
+// Junk that's sometimes left at the end of the urls, from the free form texts
+const urlJunk = " \t.,;!?\"'()[]<>"
+
+// Returns the game url as "byond://host:port" (or "byond://BYOND.world.123",
+// without a port), or an empty string if it's not a valid one. Urls without a
+// scheme, or with a http one, are assumed to be meant for byond.
+func normalizeGameURL(raw string) string {
+	raw = strings.Trim(raw, urlJunk)
+	if raw == "" {
+		return ""
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "byond://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.User != nil || strings.Trim(u.Path, "/") != "" {
+		return ""
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "byond", "http", "https":
+	default:
+		return ""
+	}
+	host := u.Hostname()
+	if host == "" || strings.ContainsAny(host, " \t") {
+		return ""
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return ""
+		}
+		host += ":" + port
+	} else if strings.HasSuffix(u.Host, ":") {
+		return ""
+	}
+	return "byond://" + host
+}
+
+// Returns the site url with a http or https scheme, or an empty string if it's
+// not a valid one. Urls without a scheme are assumed to be http.
+func normalizeSiteURL(raw string) string {
+	raw = strings.TrimRight(strings.TrimSpace(raw), urlJunk)
+	// The hub uses this for servers without a site
+	if raw == "" || raw == "http://" {
+		return ""
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.User != nil {
+		return ""
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	// The host must at least look like a domain or an IP
+	host := u.Hostname()
+	if host == "" || strings.ContainsAny(host, " \t") || !strings.ContainsAny(host, ".:") {
+		return ""
+	}
+	return u.String()
+}
+
+// Makes a server's ID, which is a SHA256 hash (in hex) of its game url, like
+// "byond://example.com:1234", since titles aren't unique and changes more often.
+// Servers without one falls back to a hash of the title, as all IDs used to be
+// made (the internal hub entry still is).
+func makeID(title, gameURL string) string {
+	if gameURL == "" {
+		return legacyID(title)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte("url:"+strings.ToLower(gameURL))))
 }
 
-func makeID(title string) string {
+// The old, title only, ID of a server
+func legacyID(title string) string {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(title)))
 }
@@ -0,0 +1,57 @@
+package ss13_se
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// Sitemap of the index and all server pages, for the search engines.
+// It only changes once per scrape, so the crawlers can cache it until the next.
+func (a *App) pageSitemap(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	_, last := a.getStatus()
+	if notModified(w, r, last) {
+		return nil
+	}
+	servers, err := a.store.GetServers(r.Context())
+	if err != nil {
+		return err
+	}
+	servers = a.removeBlocked(a.removeHubEntry(servers))
+	if err := sortServers(servers, ""); err != nil {
+		return err
+	}
+
+	base := a.baseURL(r)
+	index := sitemapURL{Loc: base + "/"}
+	if !last.IsZero() {
+		index.LastMod = last.UTC().Format(time.RFC3339)
+	}
+	set := sitemapURLSet{URLs: []sitemapURL{index}}
+	for _, s := range servers {
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:     base + "/server/" + s.ID,
+			LastMod: s.LastSeenAt().UTC().Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(a.conf.ScrapeTimeout.Seconds())))
+	if _, err := fmt.Fprint(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	return enc.Encode(set)
+}
@@ -0,0 +1,149 @@
+package ss13_se
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	chart "github.com/wcharczuk/go-chart"
+)
+
+const maxStatsDays = 30
+
+// Draws the total players and the number of servers on the same time axis.
+// There's usually a magnitude more players than servers, so the servers gets
+// their own Y axis on the left.
+func makeStatsChart(players, counts []ServerPoint, gap time.Duration, loc *time.Location) chart.Chart {
+	series := gapSeries("Players", players, gap, chart.Style{
+		Show:        true,
+		StrokeColor: chart.GetDefaultColor(0),
+	}, chart.YAxisPrimary)
+	series = append(series, gapSeries("Servers", counts, gap, chart.Style{
+		Show:        true,
+		StrokeColor: chart.GetDefaultColor(1),
+	}, chart.YAxisSecondary)...)
+
+	format := func(v interface{}) string {
+		return fmt.Sprintf("%.0f", v)
+	}
+	// Both axes starts at zero, so the lines can be compared by their shape
+	// (instead of the auto scaling blowing up small changes)
+	zeroRange := func(points []ServerPoint) *chart.ContinuousRange {
+		max := 1
+		if peak, ok := PeakOf(points); ok && peak.Players > max {
+			max = peak.Players
+		}
+		return &chart.ContinuousRange{Min: 0, Max: float64(max) * 1.1}
+	}
+	c := chart.Chart{
+		Background: chart.Style{
+			Padding: chart.Box{
+				Top: 40,
+			},
+		},
+		XAxis: chart.XAxis{
+			Style: chart.StyleShow(),
+			ValueFormatter: func(v interface{}) string {
+				t := int64(v.(float64))
+				return time.Unix(0, t).In(loc).Format("Jan 02 15:04")
+			},
+		},
+		YAxis: chart.YAxis{
+			Name:           "Players",
+			NameStyle:      chart.StyleShow(),
+			Style:          chart.StyleShow(),
+			ValueFormatter: format,
+			Range:          zeroRange(players),
+		},
+		YAxisSecondary: chart.YAxis{
+			Name:           "Servers",
+			NameStyle:      chart.StyleShow(),
+			Style:          chart.StyleShow(),
+			ValueFormatter: format,
+			Range:          zeroRange(counts),
+		},
+		Series: series,
+	}
+	c.Elements = []chart.Renderable{
+		chart.LegendThin(&c),
+	}
+	return c
+}
+
+// Parses the optional "days" query param for the stats, defaulting to a week
+func parseStatsDays(r *http.Request) (int, error) {
+	days, err := parseIntParam(r.URL.Query(), "days", 7)
+	if err != nil {
+		return 0, err
+	}
+	if days < 1 || days > maxStatsDays {
+		return 0, HttpError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("invalid days, must be between 1 and %d", maxStatsDays),
+		}
+	}
+	return days, nil
+}
+
+func (a *App) pageStats(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	days, err := parseStatsDays(r)
+	if err != nil {
+		return err
+	}
+	theme := readTheme(w, r)
+	args := chartArgs(r, theme)
+	if args == "" {
+		args = "?"
+	} else {
+		args += "&"
+	}
+	args += fmt.Sprintf("days=%d", days)
+
+	return a.renderTemplate(w, "stats", map[string]interface{}{
+		"Days":      days,
+		"ChartArgs": args,
+		"Theme":     theme,
+		"Hub":       a.getHub(),
+	})
+}
+
+// Global activity, from the hub entry's history and the server counts
+func (a *App) pageStatsChart(w http.ResponseWriter, r *http.Request, vars handlerVars) error {
+	days, err := parseStatsDays(r)
+	if err != nil {
+		return err
+	}
+	players, err := a.store.GetSingleServerHistory(r.Context(), a.hubID(), days)
+	if err != nil {
+		return err
+	}
+	counts, err := a.store.GetServerCounts(r.Context(), days)
+	if err != nil {
+		return err
+	}
+	if len(players) < 1 && len(counts) < 1 {
+		return HttpError{
+			Status: 404,
+			Err:    fmt.Errorf("no history found"),
+		}
+	}
+
+	// The counts are saved at the same time as the players, so the players
+	// are enough for the caching
+	if a.cachedChart(w, r, players) {
+		return nil
+	}
+
+	// Using the players for the counts, so they can be limited the same way
+	var points []ServerPoint
+	for _, c := range counts {
+		points = append(points, ServerPoint{Time: c.Time, Players: c.Servers})
+	}
+	players, bucket := limitPoints(players, maxChartPoints)
+	points, countBucket := limitPoints(points, maxChartPoints)
+	if countBucket > bucket {
+		bucket = countBucket
+	}
+	c := makeStatsChart(players, points, a.chartGap(bucket), a.parseTimezone(r.URL.Query()))
+	return a.renderChart(w, r, c)
+}
@@ -1,18 +1,50 @@
 package ss13_se
 
 import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
+	"math"
 	"net/url"
+	"strings"
 	"time"
 )
 
+// Returned by a Storage when a requested server entry doesn't exist
+var ErrNotFound = errors.New("not found")
+
 type ServerEntry struct {
-	ID      string    `db:"id"`
-	Title   string    `db:"title"`
-	SiteURL string    `db:"site_url"`
-	GameURL string    `db:"game_url"`
-	Time    time.Time `db:"time"`
-	Players int       `db:"players"`
+	ID      string    `db:"id" json:"id"`
+	Title   string    `db:"title" json:"title"`
+	SiteURL string    `db:"site_url" json:"siteURL"`
+	GameURL string    `db:"game_url" json:"gameURL"`
+	Time    time.Time `db:"time" json:"time"`
+	Players int       `db:"players" json:"players"`
+
+	// Optional info parsed from the server's status, empty if unknown
+	Version       string        `db:"version" json:"version"`
+	Map           string        `db:"map" json:"map"`
+	RoundDuration time.Duration `db:"round_duration" json:"roundDuration"`
+	// ISO country code of where the server is hosted, empty if unknown
+	Country string `db:"country" json:"country"`
+	// The byond hub the server was found in, see Conf.HubSources
+	Source string `db:"source" json:"source"`
+	// Older titles of the server, if it's been renamed
+	FormerTitles Titles `db:"former_titles" json:"formerTitles"`
+
+	// All time peak of players, which is never lowered when saving the entry
+	PeakPlayers int       `db:"peak_players" json:"peakPlayers"`
+	PeakTime    time.Time `db:"peak_time" json:"peakTime"`
+
+	// When the server was first found, which is never changed when saving
+	// the entry. Defaults to Time when it's zero.
+	FirstSeen time.Time `db:"first_seen" json:"firstSeen"`
+	// When the server was last found in a scrape, which is never moved back
+	// when saving the entry. Defaults to Time when it's zero.
+	LastSeen time.Time `db:"last_seen" json:"lastSeen"`
 }
 
 func (e ServerEntry) IsZero() bool {
@@ -22,6 +54,49 @@ func (e ServerEntry) IsZero() bool {
 func (e ServerEntry) LastUpdated() string {
 	return e.Time.Format("2006-01-02 15:04 MST")
 }
+
+func (e ServerEntry) FirstSeenAt() time.Time {
+	if e.FirstSeen.IsZero() {
+		return e.Time
+	}
+	return e.FirstSeen
+}
+
+func (e ServerEntry) LastSeenAt() time.Time {
+	if e.LastSeen.IsZero() {
+		return e.Time
+	}
+	return e.LastSeen
+}
+
+func (e ServerEntry) TrackedSince() string {
+	return e.FirstSeenAt().Format("2006-01-02 15:04 MST")
+}
+
+func (e ServerEntry) LastOnline() string {
+	return e.LastSeenAt().Format("2006-01-02 15:04 MST")
+}
+
+func (e ServerEntry) PeakUpdated() string {
+	return e.PeakTime.Format("2006-01-02 15:04 MST")
+}
+
+// Returns the Country as a flag emoji, or an empty string if it's unknown
+func (e ServerEntry) CountryFlag() string {
+	if len(e.Country) != 2 {
+		return ""
+	}
+	var flag []rune
+	for _, r := range strings.ToUpper(e.Country) {
+		if r < 'A' || r > 'Z' {
+			return ""
+		}
+		// Regional indicator symbols, which are shown as flags when paired
+		flag = append(flag, 0x1F1E6+(r-'A'))
+	}
+	return string(flag)
+}
+
 func (e ServerEntry) ByondURL() template.URL {
 	u, err := url.Parse(e.GameURL)
 	if err != nil {
@@ -35,25 +110,318 @@ func (e ServerEntry) ByondURL() template.URL {
 	return template.URL(u.String())
 }
 
+// Titles is saved as a JSON list in the databases
+type Titles []string
+
+func (t Titles) Value() (driver.Value, error) {
+	if t == nil {
+		t = Titles{}
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (t *Titles) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), t)
+	case []byte:
+		return json.Unmarshal(v, t)
+	}
+	return fmt.Errorf("can't scan %T into Titles", src)
+}
+
+// Returns true if title is one of the titles, ignoring case
+func (t Titles) Contains(title string) bool {
+	for _, s := range t {
+		if strings.EqualFold(s, title) {
+			return true
+		}
+	}
+	return false
+}
+
 type ServerPoint struct {
-	Time     time.Time `db:"time"`
-	ServerID string    `db:"server_id"`
-	Players  int       `db:"players"`
+	Time     time.Time `db:"time" json:"time"`
+	ServerID string    `db:"server_id" json:"serverID"`
+	Players  int       `db:"players" json:"players"`
 }
 
 func (p ServerPoint) IsZero() bool {
 	return p.ServerID == "" && p.Time.IsZero()
 }
 
+// Averages the points per server and bucket
+func averageHistory(points []ServerPoint, bucket time.Duration) []ServerPoint {
+	type key struct {
+		id string
+		t  int64
+	}
+	var keys []key
+	sums := make(map[key][2]int)
+	for _, p := range points {
+		k := key{p.ServerID, p.Time.Truncate(bucket).UnixNano()}
+		v, found := sums[k]
+		if !found {
+			keys = append(keys, k)
+		}
+		sums[k] = [2]int{v[0] + p.Players, v[1] + 1}
+	}
+
+	var averaged []ServerPoint
+	for _, k := range keys {
+		v := sums[k]
+		averaged = append(averaged, ServerPoint{
+			Time:     time.Unix(0, k.t),
+			ServerID: k.id,
+			Players:  int(math.Round(float64(v[0]) / float64(v[1]))),
+		})
+	}
+	return averaged
+}
+
+// Number of servers found in a scrape
+type ServerCount struct {
+	Time    time.Time `db:"time" json:"time"`
+	Servers int       `db:"servers" json:"servers"`
+}
+
+type EventKind string
+
+const (
+	EventOnline  EventKind = "online"
+	EventOffline EventKind = "offline"
+)
+
+// Marks when a server appeared or disappeared from the hub
+type ServerEvent struct {
+	ServerID string    `db:"server_id" json:"serverID"`
+	Kind     EventKind `db:"kind" json:"kind"`
+	Time     time.Time `db:"time" json:"time"`
+}
+
+func (e ServerEvent) Updated() string {
+	return e.Time.Format("2006-01-02 15:04 MST")
+}
+
+// How servers are ranked by Storage.GetTopServers
+type TopMetric string
+
+const (
+	TopByAverage TopMetric = "average"
+	TopByPeak    TopMetric = "peak"
+	// Player-hours per day, which is integrated from the history by the app
+	// and isn't supported by Storage.GetTopServers
+	TopByPlayerHours TopMetric = "playerhours"
+)
+
+// Returns the SQL aggregate for metric, over the history players as "h.players"
+func topMetricSQL(metric TopMetric) (string, error) {
+	switch metric {
+	case TopByAverage:
+		return "CAST(AVG(h.players) AS DOUBLE PRECISION)", nil
+	case TopByPeak:
+		return "CAST(MAX(h.players) AS DOUBLE PRECISION)", nil
+	}
+	return "", fmt.Errorf("unknown top metric: %q", metric)
+}
+
+// A server's average or peak players over some time window
+type TopServer struct {
+	ID    string  `db:"id" json:"id"`
+	Title string  `db:"title" json:"title"`
+	Value float64 `db:"value" json:"value"`
+}
+
+// A page of servers, filtered and sorted, as returned by Storage.GetServersPage
+type ServerQuery struct {
+	// Sorted by "players" or "title", see sortServers
+	Sort   string
+	Offset int
+	// All servers after the offset are returned if it's less than 1
+	Limit int
+
+	// Optional filters, skipped when empty or zero
+	Country    string // Ignoring case
+	Source     string // Ignoring case
+	MinPlayers int
+	ExcludeIDs []string
+}
+
+// Returns the filtered page of servers and the total number of servers
+// matching the query, before the paging. For backends that can't do it in
+// their queries.
+func queryServers(servers []ServerEntry, q ServerQuery) ([]ServerEntry, int, error) {
+	var filtered []ServerEntry
+	exclude := make(map[string]bool)
+	for _, id := range q.ExcludeIDs {
+		exclude[id] = true
+	}
+	for _, s := range servers {
+		if !exclude[s.ID] {
+			filtered = append(filtered, s)
+		}
+	}
+	if q.Country != "" {
+		filtered = filterCountry(filtered, q.Country)
+	}
+	if q.Source != "" {
+		filtered = filterSource(filtered, q.Source)
+	}
+	filtered = filterPlayers(filtered, q.MinPlayers)
+	if err := sortServers(filtered, q.Sort); err != nil {
+		return nil, 0, err
+	}
+
+	total := len(filtered)
+	start, end := q.Offset, total
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+	if start > end {
+		start = end
+	}
+	return filtered[start:end], total, nil
+}
+
+// Returns the WHERE and ORDER BY clauses for a server query, together with
+// the args for the WHERE. Uses "?" as the placeholders, so Rebind as needed.
+func serverQuerySQL(q ServerQuery) (string, string, []interface{}, error) {
+	var order string
+	switch q.Sort {
+	case "", "players":
+		order = "players DESC, id ASC"
+	case "-", "-players":
+		order = "players ASC, id DESC"
+	case "title":
+		order = "LOWER(title) ASC, id ASC"
+	case "-title":
+		order = "LOWER(title) DESC, id DESC"
+	default:
+		return "", "", nil, validSort(q.Sort)
+	}
+
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if q.Country != "" {
+		where = append(where, "LOWER(country) = LOWER(?)")
+		args = append(args, q.Country)
+	}
+	if q.Source != "" {
+		where = append(where, "LOWER(source) = LOWER(?)")
+		args = append(args, q.Source)
+	}
+	if q.MinPlayers > 0 {
+		where = append(where, "players >= ?")
+		args = append(args, q.MinPlayers)
+	}
+	for _, id := range q.ExcludeIDs {
+		where = append(where, "id != ?")
+		args = append(args, id)
+	}
+	return "WHERE " + strings.Join(where, " AND "), "ORDER BY " + order, args, nil
+}
+
+// Key for the time where the last Storage.DownsampleHistory stopped, for the
+// backends that keeps some state of their own
+const storageMetaDownsampled = "downsampled_until"
+
+// Rough numbers about what's stored, for keeping an eye on the disk space
+type StorageStats struct {
+	Servers       int `db:"servers" json:"servers"`
+	HistoryPoints int `db:"history_points" json:"historyPoints"`
+	// Time of the oldest and newest history points, zero if there's none
+	OldestPoint time.Time `json:"oldestPoint"`
+	NewestPoint time.Time `json:"newestPoint"`
+	// Approximate size in bytes, zero if the backend can't tell
+	Size int64 `db:"size" json:"size"`
+}
+
+// Storage v2: all methods, except Close, takes a context as the first arg.
+// Backends should give up and return the context's error when it's canceled,
+// though the in-memory one simply ignores it.
 type Storage interface {
-	Open() error
+	Open(ctx context.Context) error
+	Close() error
+
+	// SaveServers inserts new entries or updates old ones, so saving the same
+	// entries again changes nothing. The derived fields of an old entry are
+	// only replaced by "greater" new values, so it must keep:
+	//  - the highest PeakPlayers (and its PeakTime, if the new one is equal)
+	//  - the earliest FirstSeen and the latest LastSeen
+	//  - the old FormerTitles, unless the new list isn't empty (the updater
+	//    always saves the old titles together with any new ones)
+	SaveServers(ctx context.Context, servers []ServerEntry) error
+	GetServer(ctx context.Context, id string) (ServerEntry, error)
+	GetServers(ctx context.Context) ([]ServerEntry, error)
+	// Returns a page of the servers and the total number of servers that
+	// matches the query, so not all of them has to be loaded for the lists
+	GetServersPage(ctx context.Context, q ServerQuery) ([]ServerEntry, int, error)
+	// Returns the most recently found servers, with the newest first
+	GetNewServers(ctx context.Context, limit int) ([]ServerEntry, error)
+	// Returns the most recently updated server with the game url, or
+	// ErrNotFound if there's none
+	GetServerByGameURL(ctx context.Context, gameURL string) (ServerEntry, error)
+	// Returns the servers with titles containing the query, ignoring case
+	SearchServers(ctx context.Context, query string) ([]ServerEntry, error)
+	// RemoveServers also removes all history and events for the servers
+	RemoveServers(ctx context.Context, servers []ServerEntry) error
+	// Changes the ID of a server, together with its history and events.
+	// There must not be another server using the new ID.
+	RenameServer(ctx context.Context, oldID, newID string) error
 
-	SaveServers([]ServerEntry) error
-	GetServer(string) (ServerEntry, error)
-	GetServers() ([]ServerEntry, error)
-	RemoveServers([]ServerEntry) error
+	// SaveServerHistory must save all points in a single transaction (or
+	// batch), so either all of them are saved or none at all. A point with
+	// the same ServerID and Time as an old one replaces it, so saving the
+	// same scrape twice doesn't duplicate the history. It's called once
+	// per scrape with all the points, so the SQL backends should send them
+	// in as few round-trips as possible (instead of one per point).
+	SaveServerHistory(ctx context.Context, points []ServerPoint) error
+	GetServerHistory(ctx context.Context, days int) ([]ServerPoint, error)
+	GetSingleServerHistory(ctx context.Context, id string, days int) ([]ServerPoint, error)
+	GetServerHistoryRange(ctx context.Context, id string, from, to time.Time) ([]ServerPoint, error)
+	// Returns the points of all servers from the latest scrape at, or
+	// before, t. Empty if there's no history that old.
+	GetHistorySnapshot(ctx context.Context, t time.Time) ([]ServerPoint, error)
+	// Replaces all points older than before with their averages per bucket.
+	// Only the points since where the last run stopped are downsampled, so
+	// the work stays the same no matter how much old history there is.
+	DownsampleHistory(ctx context.Context, before time.Time, bucket time.Duration) error
+	// Removes all points, and server counts, older than before
+	RemoveOldHistory(ctx context.Context, before time.Time) error
+	// Ranks the servers by their history during the last window, with the
+	// highest first. Equal servers are ordered by their title.
+	GetTopServers(ctx context.Context, window time.Duration, metric TopMetric, limit int) ([]TopServer, error)
 
-	SaveServerHistory([]ServerPoint) error
-	GetServerHistory(int) ([]ServerPoint, error)
-	GetSingleServerHistory(string, int) ([]ServerPoint, error)
+	SaveServerCount(ctx context.Context, count ServerCount) error
+	// Returns the server counts during the last days, with the newest first
+	GetServerCounts(ctx context.Context, days int) ([]ServerCount, error)
+
+	SaveServerEvents(ctx context.Context, events []ServerEvent) error
+	// Returns the latest events for a server, with the newest first
+	GetServerEvents(ctx context.Context, id string, limit int) ([]ServerEvent, error)
+	// Returns all events for a server after since, with the newest first
+	GetServerEventsSince(ctx context.Context, id string, since time.Time) ([]ServerEvent, error)
+
+	// Returns the stats as cheaply as possible, so they might be estimates
+	Stats(ctx context.Context) (StorageStats, error)
+
+	// Small bits of state for the app that must survive restarts, like the
+	// last week the digests were sent. GetMeta returns ErrNotFound if the key
+	// hasn't been saved. The storage keeps its own state here too, see
+	// storageMetaDownsampled.
+	GetMeta(ctx context.Context, key string) (string, error)
+	SaveMeta(ctx context.Context, key, value string) error
 }
+
+var (
+	_ Storage = &StorageSqlite{}
+	_ Storage = &StorageMemory{}
+	_ Storage = &StoragePostgres{}
+)
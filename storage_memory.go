@@ -0,0 +1,486 @@
+package ss13_se
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StorageMemory keeps everything in memory and is safe for concurrent use.
+// Useful for tests and small deployments, where history can be lost on restarts.
+type StorageMemory struct {
+	lock    sync.RWMutex
+	servers map[string]ServerEntry
+	history []ServerPoint
+	events  []ServerEvent
+	counts  []ServerCount
+	// Including where the last DownsampleHistory stopped, like the other
+	// backends, so it's copied by CopyStorage too
+	meta map[string]string
+}
+
+// Returns an empty StorageMemory
+func NewStorageMemory() *StorageMemory {
+	return &StorageMemory{}
+}
+
+func (store *StorageMemory) Open(ctx context.Context) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.servers == nil {
+		store.servers = make(map[string]ServerEntry)
+	}
+	if store.meta == nil {
+		store.meta = make(map[string]string)
+	}
+	return nil
+}
+
+func (store *StorageMemory) Close() error {
+	return nil
+}
+
+func (store *StorageMemory) SaveServers(ctx context.Context, servers []ServerEntry) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, s := range servers {
+		s.FirstSeen = s.FirstSeenAt()
+		s.LastSeen = s.LastSeenAt()
+		if old, found := store.servers[s.ID]; found {
+			if old.PeakPlayers >= s.PeakPlayers {
+				s.PeakPlayers = old.PeakPlayers
+				s.PeakTime = old.PeakTime
+			}
+			if old.FirstSeen.Before(s.FirstSeen) {
+				s.FirstSeen = old.FirstSeen
+			}
+			if old.LastSeen.After(s.LastSeen) {
+				s.LastSeen = old.LastSeen
+			}
+			if len(s.FormerTitles) < 1 {
+				s.FormerTitles = old.FormerTitles
+			}
+		}
+		store.servers[s.ID] = s
+	}
+	return nil
+}
+
+func (store *StorageMemory) GetServer(ctx context.Context, id string) (ServerEntry, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	s, ok := store.servers[id]
+	if !ok {
+		return ServerEntry{}, ErrNotFound
+	}
+	return s, nil
+}
+
+func (store *StorageMemory) GetServers(ctx context.Context) ([]ServerEntry, error) {
+	return store.filterServers(func(ServerEntry) bool {
+		return true
+	}), nil
+}
+
+func (store *StorageMemory) GetServersPage(ctx context.Context, q ServerQuery) ([]ServerEntry, int, error) {
+	servers := store.filterServers(func(ServerEntry) bool {
+		return true
+	})
+	return queryServers(servers, q)
+}
+
+func (store *StorageMemory) GetNewServers(ctx context.Context, limit int) ([]ServerEntry, error) {
+	servers := store.filterServers(func(ServerEntry) bool {
+		return true
+	})
+	sort.SliceStable(servers, func(i, j int) bool {
+		if !servers[i].FirstSeen.Equal(servers[j].FirstSeen) {
+			return servers[i].FirstSeen.After(servers[j].FirstSeen)
+		}
+		return servers[i].ID < servers[j].ID
+	})
+	if len(servers) > limit {
+		servers = servers[:limit]
+	}
+	return servers, nil
+}
+
+func (store *StorageMemory) GetServerByGameURL(ctx context.Context, gameURL string) (ServerEntry, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	var found ServerEntry
+	for _, s := range store.servers {
+		if s.GameURL == gameURL && (found.IsZero() || s.Time.After(found.Time)) {
+			found = s
+		}
+	}
+	if found.IsZero() {
+		return ServerEntry{}, ErrNotFound
+	}
+	return found, nil
+}
+
+func (store *StorageMemory) SearchServers(ctx context.Context, query string) ([]ServerEntry, error) {
+	query = strings.ToLower(query)
+	return store.filterServers(func(s ServerEntry) bool {
+		return strings.Contains(strings.ToLower(s.Title), query)
+	}), nil
+}
+
+// Returns all servers matching fn, sorted by players and ID
+func (store *StorageMemory) filterServers(fn func(ServerEntry) bool) []ServerEntry {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	var servers []ServerEntry
+	for _, s := range store.servers {
+		if fn(s) {
+			servers = append(servers, s)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Players != servers[j].Players {
+			return servers[i].Players > servers[j].Players
+		}
+		return servers[i].ID < servers[j].ID
+	})
+	return servers
+}
+
+func (store *StorageMemory) RemoveServers(ctx context.Context, servers []ServerEntry) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	remove := make(map[string]bool)
+	for _, s := range servers {
+		remove[s.ID] = true
+		delete(store.servers, s.ID)
+	}
+
+	var history []ServerPoint
+	for _, p := range store.history {
+		if !remove[p.ServerID] {
+			history = append(history, p)
+		}
+	}
+	store.history = history
+
+	var events []ServerEvent
+	for _, e := range store.events {
+		if !remove[e.ServerID] {
+			events = append(events, e)
+		}
+	}
+	store.events = events
+	return nil
+}
+
+func (store *StorageMemory) RenameServer(ctx context.Context, oldID, newID string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if s, found := store.servers[oldID]; found {
+		delete(store.servers, oldID)
+		s.ID = newID
+		store.servers[newID] = s
+	}
+	for i := range store.history {
+		if store.history[i].ServerID == oldID {
+			store.history[i].ServerID = newID
+		}
+	}
+	for i := range store.events {
+		if store.events[i].ServerID == oldID {
+			store.events[i].ServerID = newID
+		}
+	}
+	return nil
+}
+
+func (store *StorageMemory) SaveServerHistory(ctx context.Context, points []ServerPoint) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	// Replaces the old points in a single pass, or else each point would
+	// have to go through the whole history
+	type key struct {
+		id string
+		t  int64
+	}
+	newPoints := make(map[key]int, len(points))
+	for i, p := range points {
+		newPoints[key{p.ServerID, p.Time.UnixNano()}] = i
+	}
+	for i, p := range store.history {
+		k := key{p.ServerID, p.Time.UnixNano()}
+		if j, ok := newPoints[k]; ok {
+			store.history[i] = points[j]
+			delete(newPoints, k)
+		}
+	}
+	for i, p := range points {
+		k := key{p.ServerID, p.Time.UnixNano()}
+		if j, ok := newPoints[k]; ok && j == i {
+			store.history = append(store.history, p)
+		}
+	}
+	return nil
+}
+
+// Returns all points matching fn, sorted with the newest first
+func (store *StorageMemory) filterHistory(fn func(ServerPoint) bool) []ServerPoint {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	var points []ServerPoint
+	for _, p := range store.history {
+		if fn(p) {
+			points = append(points, p)
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		if !points[i].Time.Equal(points[j].Time) {
+			return points[i].Time.After(points[j].Time)
+		}
+		return points[i].ServerID < points[j].ServerID
+	})
+	return points
+}
+
+func (store *StorageMemory) GetServerHistory(ctx context.Context, days int) ([]ServerPoint, error) {
+	delta := time.Now().AddDate(0, 0, -days)
+	return store.filterHistory(func(p ServerPoint) bool {
+		return p.Time.After(delta)
+	}), nil
+}
+
+func (store *StorageMemory) GetSingleServerHistory(ctx context.Context, id string, days int) ([]ServerPoint, error) {
+	delta := time.Now().AddDate(0, 0, -days)
+	return store.filterHistory(func(p ServerPoint) bool {
+		return p.ServerID == id && p.Time.After(delta)
+	}), nil
+}
+
+func (store *StorageMemory) GetServerHistoryRange(ctx context.Context, id string, from, to time.Time) ([]ServerPoint, error) {
+	return store.filterHistory(func(p ServerPoint) bool {
+		return p.ServerID == id && p.Time.After(from) && !p.Time.After(to)
+	}), nil
+}
+
+func (store *StorageMemory) GetHistorySnapshot(ctx context.Context, t time.Time) ([]ServerPoint, error) {
+	store.lock.RLock()
+	var latest time.Time
+	for _, p := range store.history {
+		if !p.Time.After(t) && p.Time.After(latest) {
+			latest = p.Time
+		}
+	}
+	store.lock.RUnlock()
+	if latest.IsZero() {
+		return nil, nil
+	}
+	points := store.filterHistory(func(p ServerPoint) bool {
+		return p.Time.Equal(latest)
+	})
+	return points, nil
+}
+
+func (store *StorageMemory) DownsampleHistory(ctx context.Context, before time.Time, bucket time.Duration) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	before = before.Truncate(bucket)
+	var done time.Time
+	if value, found := store.meta[storageMetaDownsampled]; found {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return err
+		}
+		done = t
+	}
+	if !before.After(done) {
+		return nil
+	}
+	var keep, old []ServerPoint
+	for _, p := range store.history {
+		if !p.Time.Before(done) && p.Time.Before(before) {
+			old = append(old, p)
+		} else {
+			keep = append(keep, p)
+		}
+	}
+	store.history = append(averageHistory(old, bucket), keep...)
+	store.meta[storageMetaDownsampled] = before.UTC().Format(time.RFC3339Nano)
+	return nil
+}
+
+func (store *StorageMemory) RemoveOldHistory(ctx context.Context, before time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var keep []ServerPoint
+	for _, p := range store.history {
+		if !p.Time.Before(before) {
+			keep = append(keep, p)
+		}
+	}
+	store.history = keep
+
+	var keepCounts []ServerCount
+	for _, c := range store.counts {
+		if !c.Time.Before(before) {
+			keepCounts = append(keepCounts, c)
+		}
+	}
+	store.counts = keepCounts
+	return nil
+}
+
+func (store *StorageMemory) GetTopServers(ctx context.Context, window time.Duration, metric TopMetric, limit int) ([]TopServer, error) {
+	switch metric {
+	case TopByAverage, TopByPeak:
+	default:
+		return nil, fmt.Errorf("unknown top metric: %q", metric)
+	}
+	delta := time.Now().Add(-window)
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	sums := make(map[string]int)
+	counts := make(map[string]int)
+	peaks := make(map[string]int)
+	for _, p := range store.history {
+		if !p.Time.After(delta) {
+			continue
+		}
+		if _, found := store.servers[p.ServerID]; !found {
+			continue
+		}
+		sums[p.ServerID] += p.Players
+		counts[p.ServerID]++
+		if p.Players > peaks[p.ServerID] {
+			peaks[p.ServerID] = p.Players
+		}
+	}
+
+	var servers []TopServer
+	for id, count := range counts {
+		v := float64(peaks[id])
+		if metric == TopByAverage {
+			v = float64(sums[id]) / float64(count)
+		}
+		servers = append(servers, TopServer{
+			ID:    id,
+			Title: store.servers[id].Title,
+			Value: v,
+		})
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Value != servers[j].Value {
+			return servers[i].Value > servers[j].Value
+		}
+		if servers[i].Title != servers[j].Title {
+			return servers[i].Title < servers[j].Title
+		}
+		return servers[i].ID < servers[j].ID
+	})
+	if len(servers) > limit {
+		servers = servers[:limit]
+	}
+	return servers, nil
+}
+
+func (store *StorageMemory) SaveServerCount(ctx context.Context, count ServerCount) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.counts = append(store.counts, count)
+	return nil
+}
+
+func (store *StorageMemory) GetServerCounts(ctx context.Context, days int) ([]ServerCount, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	delta := time.Now().AddDate(0, 0, -days)
+	var counts []ServerCount
+	for _, c := range store.counts {
+		if c.Time.After(delta) {
+			counts = append(counts, c)
+		}
+	}
+	sort.SliceStable(counts, func(i, j int) bool {
+		return counts[i].Time.After(counts[j].Time)
+	})
+	return counts, nil
+}
+
+func (store *StorageMemory) SaveServerEvents(ctx context.Context, events []ServerEvent) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.events = append(store.events, events...)
+	return nil
+}
+
+func (store *StorageMemory) GetServerEvents(ctx context.Context, id string, limit int) ([]ServerEvent, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	var events []ServerEvent
+	for _, e := range store.events {
+		if e.ServerID == id {
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (store *StorageMemory) GetServerEventsSince(ctx context.Context, id string, since time.Time) ([]ServerEvent, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	var events []ServerEvent
+	for _, e := range store.events {
+		if e.ServerID == id && e.Time.After(since) {
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	return events, nil
+}
+
+// The size is left as zero, as there's no good way to tell
+func (store *StorageMemory) Stats(ctx context.Context) (StorageStats, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	stats := StorageStats{
+		Servers:       len(store.servers),
+		HistoryPoints: len(store.history),
+	}
+	for _, p := range store.history {
+		if stats.OldestPoint.IsZero() || p.Time.Before(stats.OldestPoint) {
+			stats.OldestPoint = p.Time
+		}
+		if p.Time.After(stats.NewestPoint) {
+			stats.NewestPoint = p.Time
+		}
+	}
+	return stats, nil
+}
+
+func (store *StorageMemory) GetMeta(ctx context.Context, key string) (string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	value, found := store.meta[key]
+	if !found {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (store *StorageMemory) SaveMeta(ctx context.Context, key, value string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.meta[key] = value
+	return nil
+}
@@ -0,0 +1,14 @@
+package ss13_se
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStorageMemory(t *testing.T) {
+	store := NewStorageMemory()
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, store)
+}
@@ -1,6 +1,12 @@
 package ss13_se
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -29,35 +35,199 @@ CREATE TABLE IF NOT EXISTS server_history (
 CREATE INDEX IF NOT EXISTS idx_server_history ON server_history(time, server_id);
 `
 
+// Schema changes done after the initial scheme, run in order and only once.
+// The sqlite user_version keeps track of which ones has been run already.
+var sqliteMigrations = []string{
+	`ALTER TABLE server_entry ADD COLUMN version TEXT NOT NULL DEFAULT '';
+	ALTER TABLE server_entry ADD COLUMN map TEXT NOT NULL DEFAULT '';
+	ALTER TABLE server_entry ADD COLUMN round_duration INTEGER NOT NULL DEFAULT 0;`,
+
+	`ALTER TABLE server_entry ADD COLUMN peak_players INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE server_entry ADD COLUMN peak_time DATETIME;
+	UPDATE server_entry SET peak_players = players, peak_time = time;
+	UPDATE server_entry SET (peak_players, peak_time) = (
+		SELECT players, time FROM server_history WHERE server_id = server_entry.id
+		ORDER BY players DESC, time ASC LIMIT 1
+	) WHERE EXISTS (SELECT 1 FROM server_history WHERE server_id = server_entry.id)
+	AND (SELECT MAX(players) FROM server_history WHERE server_id = server_entry.id) > peak_players;`,
+
+	`CREATE TABLE server_event (
+		id INTEGER PRIMARY KEY,
+		time DATETIME,
+		server_id TEXT,
+		kind TEXT
+	);
+	CREATE INDEX idx_server_event ON server_event(server_id, time);`,
+
+	`ALTER TABLE server_entry ADD COLUMN country TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE server_entry ADD COLUMN former_titles TEXT NOT NULL DEFAULT '[]';
+	CREATE INDEX idx_server_entry_game_url ON server_entry(game_url);`,
+
+	`ALTER TABLE server_entry ADD COLUMN first_seen DATETIME;
+	UPDATE server_entry SET first_seen = time;
+	UPDATE server_entry SET first_seen = (
+		SELECT MIN(time) FROM server_history WHERE server_id = server_entry.id
+	) WHERE EXISTS (SELECT 1 FROM server_history WHERE server_id = server_entry.id);
+	CREATE INDEX idx_server_entry_first_seen ON server_entry(first_seen);`,
+
+	// All older servers came from the SS13 hub
+	`ALTER TABLE server_entry ADD COLUMN source TEXT NOT NULL DEFAULT 'Exadv1/SpaceStation13';`,
+
+	`ALTER TABLE server_entry ADD COLUMN last_seen DATETIME;
+	UPDATE server_entry SET last_seen = time;`,
+
+	`CREATE TABLE server_count (
+		id INTEGER PRIMARY KEY,
+		time DATETIME,
+		servers INTEGER
+	);
+	CREATE INDEX idx_server_count ON server_count(time);`,
+
+	// Keeps the latest of any duplicated points
+	`DELETE FROM server_history WHERE id NOT IN (
+		SELECT MAX(id) FROM server_history GROUP BY server_id, time
+	);
+	CREATE UNIQUE INDEX idx_server_history_unique ON server_history(server_id, time);`,
+
+	// Small bits of state that must survive restarts, see storageMetaDownsampled
+	// and Storage.GetMeta
+	`CREATE TABLE storage_meta (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+
+	// The times are compared as strings, so they must all be in the same zone
+	// to be in order. The older ones were saved in the local zone and are
+	// moved to UTC, in the same format as go-sqlite3 saves them (though only
+	// keeping the milliseconds).
+	`UPDATE OR REPLACE server_history SET time = rtrim(rtrim(strftime('%Y-%m-%d %H:%M:%f', time), '0'), '.') || '+00:00'
+	WHERE time NOT LIKE '%+00:00' AND strftime('%s', time) IS NOT NULL;
+	UPDATE server_count SET time = rtrim(rtrim(strftime('%Y-%m-%d %H:%M:%f', time), '0'), '.') || '+00:00'
+	WHERE time NOT LIKE '%+00:00' AND strftime('%s', time) IS NOT NULL;
+	UPDATE server_event SET time = rtrim(rtrim(strftime('%Y-%m-%d %H:%M:%f', time), '0'), '.') || '+00:00'
+	WHERE time NOT LIKE '%+00:00' AND strftime('%s', time) IS NOT NULL;`,
+}
+
+// StorageSqlite is the default storage, keeping everything in a single file.
 type StorageSqlite struct {
 	*sqlx.DB
+	// File path to the database, its dir is created if it's missing.
+	// Can also be ":memory:" or a "file:" URI, as understood by go-sqlite3.
 	Path string
 }
 
-func (store *StorageSqlite) Open() error {
-	db, err := sqlx.Connect("sqlite3", store.Path)
+// Returns a StorageSqlite for the database file at path.
+// Nothing is opened or created until Open is called.
+func NewStorageSqlite(path string) *StorageSqlite {
+	return &StorageSqlite{Path: path}
+}
+
+func (store *StorageSqlite) Open(ctx context.Context) error {
+	if err := makeSqliteDir(store.Path); err != nil {
+		return err
+	}
+	db, err := sqlx.ConnectContext(ctx, "sqlite3", store.Path)
+	if err != nil {
+		return err
+	}
+
+	// Lets readers keep working while the updater is writing. It's persisted
+	// in the database file, so only has to be set once really.
+	_, err = db.ExecContext(ctx, `PRAGMA journal_mode = WAL;`)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(sqliteScheme)
+	_, err = db.ExecContext(ctx, sqliteScheme)
 	if err != nil {
 		return err
 	}
 
+	if err := migrateSqlite(ctx, db); err != nil {
+		return err
+	}
+
 	store.DB = db
 	return nil
 }
 
-func (store *StorageSqlite) SaveServers(servers []ServerEntry) error {
-	tx, err := store.Begin()
+// Creates the dir for the database file, only readable by the user and group
+func makeSqliteDir(path string) error {
+	if path == "" || path == ":memory:" || strings.HasPrefix(path, "file:") {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("sqlite: %w", err)
+	}
+	return nil
+}
+
+func migrateSqlite(ctx context.Context, db *sqlx.DB) error {
+	var version int
+	if err := db.GetContext(ctx, &version, `PRAGMA user_version;`); err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sqliteMigrations[i]); err != nil {
+			tx.Rollback() // TODO: handle error?
+			return fmt.Errorf("migration %d: %s", i+1, err)
+		}
+		// PRAGMA doesn't support placeholders
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d;`, i+1)); err != nil {
+			tx.Rollback() // TODO: handle error?
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *StorageSqlite) Close() error {
+	return store.DB.Close()
+}
+
+func (store *StorageSqlite) SaveServers(ctx context.Context, servers []ServerEntry) error {
+	tx, err := store.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	q := `INSERT INTO server_entry (id, title, site_url, game_url, time, players, version, map, round_duration, country, source, former_titles, peak_players, peak_time, first_seen, last_seen)
+	VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET
+		title = excluded.title,
+		site_url = excluded.site_url,
+		game_url = excluded.game_url,
+		time = excluded.time,
+		players = excluded.players,
+		version = excluded.version,
+		map = excluded.map,
+		round_duration = excluded.round_duration,
+		country = excluded.country,
+		source = excluded.source,
+		former_titles = CASE WHEN excluded.former_titles = '[]' THEN former_titles ELSE excluded.former_titles END,
+		first_seen = MIN(COALESCE(first_seen, excluded.first_seen), excluded.first_seen),
+		last_seen = MAX(COALESCE(last_seen, excluded.last_seen), excluded.last_seen),
+		peak_players = MAX(peak_players, excluded.peak_players),
+		peak_time = CASE WHEN excluded.peak_players > peak_players THEN excluded.peak_time ELSE peak_time END;`
+	stmt, err := tx.PrepareContext(ctx, q)
 	if err != nil {
+		tx.Rollback() // TODO: handle error?
 		return err
 	}
+	defer stmt.Close()
 
-	q := `INSERT OR REPLACE INTO server_entry (id, title, site_url, game_url, time, players) VALUES(?, ?, ?, ?, ?, ?);`
 	for _, s := range servers {
-		_, err := tx.Exec(q, s.ID, s.Title, s.SiteURL, s.GameURL, s.Time, s.Players)
+		_, err := stmt.ExecContext(ctx, s.ID, s.Title, s.SiteURL, s.GameURL, s.Time, s.Players, s.Version, s.Map, s.RoundDuration, s.Country, s.Source, s.FormerTitles, s.PeakPlayers, s.PeakTime, s.FirstSeenAt(), s.LastSeenAt())
 		if err != nil {
 			tx.Rollback() // TODO: handle error?
 			return err
@@ -67,42 +237,105 @@ func (store *StorageSqlite) SaveServers(servers []ServerEntry) error {
 	return tx.Commit()
 }
 
-func (store *StorageSqlite) GetServer(id string) (ServerEntry, error) {
+func (store *StorageSqlite) GetServer(ctx context.Context, id string) (ServerEntry, error) {
 	var server ServerEntry
 	q := `SELECT * FROM server_entry WHERE id = ? LIMIT 1;`
-	err := store.Get(&server, q, id)
-	if err != nil {
+	err := store.GetContext(ctx, &server, q, id)
+	if err == sql.ErrNoRows {
+		return ServerEntry{}, ErrNotFound
+	} else if err != nil {
 		return ServerEntry{}, err
 	}
 	return server, nil
 }
 
-func (store *StorageSqlite) GetServers() ([]ServerEntry, error) {
+func (store *StorageSqlite) GetServers(ctx context.Context) ([]ServerEntry, error) {
 	var servers []ServerEntry
 	q := `SELECT * FROM server_entry ORDER BY players DESC, id ASC;`
-	err := store.Select(&servers, q)
+	err := store.SelectContext(ctx, &servers, q)
+	if err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+func (store *StorageSqlite) GetServersPage(ctx context.Context, q ServerQuery) ([]ServerEntry, int, error) {
+	where, order, args, err := serverQuerySQL(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int
+	if err := store.GetContext(ctx, &total, `SELECT COUNT(*) FROM server_entry `+where+`;`, args...); err != nil {
+		return nil, 0, err
+	}
+	limit := q.Limit
+	if limit < 1 {
+		limit = -1 // No limit
+	}
+	var servers []ServerEntry
+	query := `SELECT * FROM server_entry ` + where + ` ` + order + ` LIMIT ? OFFSET ?;`
+	err = store.SelectContext(ctx, &servers, query, append(args, limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return servers, total, nil
+}
+
+func (store *StorageSqlite) GetNewServers(ctx context.Context, limit int) ([]ServerEntry, error) {
+	var servers []ServerEntry
+	q := `SELECT * FROM server_entry ORDER BY first_seen DESC, id ASC LIMIT ?;`
+	err := store.SelectContext(ctx, &servers, q, limit)
+	if err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+func (store *StorageSqlite) GetServerByGameURL(ctx context.Context, gameURL string) (ServerEntry, error) {
+	var server ServerEntry
+	q := `SELECT * FROM server_entry WHERE game_url = ? ORDER BY time DESC LIMIT 1;`
+	err := store.GetContext(ctx, &server, q, gameURL)
+	if err == sql.ErrNoRows {
+		return ServerEntry{}, ErrNotFound
+	} else if err != nil {
+		return ServerEntry{}, err
+	}
+	return server, nil
+}
+
+func (store *StorageSqlite) SearchServers(ctx context.Context, query string) ([]ServerEntry, error) {
+	var servers []ServerEntry
+	q := `SELECT * FROM server_entry WHERE instr(lower(title), lower(?)) > 0 ORDER BY players DESC, id ASC;`
+	err := store.SelectContext(ctx, &servers, q, query)
 	if err != nil {
 		return nil, err
 	}
 	return servers, nil
 }
 
-func (store *StorageSqlite) RemoveServers(servers []ServerEntry) error {
-	tx, err := store.Begin()
+func (store *StorageSqlite) RemoveServers(ctx context.Context, servers []ServerEntry) error {
+	tx, err := store.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
 	qHistory := `DELETE FROM server_history WHERE server_id = ?;`
+	qEvents := `DELETE FROM server_event WHERE server_id = ?;`
 	qEntry := `DELETE FROM server_entry WHERE id = ?;`
 	for _, s := range servers {
-		_, err := tx.Exec(qHistory, s.ID)
+		_, err := tx.ExecContext(ctx, qHistory, s.ID)
+		if err != nil {
+			tx.Rollback() // TODO: handle error?
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, qEvents, s.ID)
 		if err != nil {
 			tx.Rollback() // TODO: handle error?
 			return err
 		}
 
-		_, err = tx.Exec(qEntry, s.ID)
+		_, err = tx.ExecContext(ctx, qEntry, s.ID)
 		if err != nil {
 			tx.Rollback() // TODO: handle error?
 			return err
@@ -112,42 +345,334 @@ func (store *StorageSqlite) RemoveServers(servers []ServerEntry) error {
 	return tx.Commit()
 }
 
-func (store *StorageSqlite) SaveServerHistory(points []ServerPoint) error {
-	tx, err := store.Begin()
+func (store *StorageSqlite) RenameServer(ctx context.Context, oldID, newID string) error {
+	tx, err := store.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	q := `INSERT INTO server_history (time, server_id, players) VALUES(?, ?, ?);`
-	for _, p := range points {
-		_, err := tx.Exec(q, p.Time, p.ServerID, p.Players)
-		if err != nil {
+	for _, q := range []string{
+		`UPDATE server_history SET server_id = ? WHERE server_id = ?;`,
+		`UPDATE server_event SET server_id = ? WHERE server_id = ?;`,
+		`UPDATE server_entry SET id = ? WHERE id = ?;`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, newID, oldID); err != nil {
+			tx.Rollback() // TODO: handle error?
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const (
+	// The SQLITE_MAX_VARIABLE_NUMBER of go-sqlite3 v1.10.0, above which a
+	// statement fails with "too many SQL variables"
+	sqliteMaxVariables = 999
+	// Max points per INSERT. Each one takes 3 variables (time, server_id and
+	// players), so 300 rows uses 900 of them.
+	sqliteHistoryChunk = 300
+)
+
+// Saves the points with multi-row INSERTs, instead of one per point, so a
+// normal scrape only needs a single statement
+func (store *StorageSqlite) SaveServerHistory(ctx context.Context, points []ServerPoint) error {
+	tx, err := store.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for len(points) > 0 {
+		n := min(len(points), sqliteHistoryChunk)
+		args := make([]interface{}, 0, n*3)
+		for _, p := range points[:n] {
+			args = append(args, p.Time.UTC(), p.ServerID, p.Players)
+		}
+		q := `INSERT INTO server_history (time, server_id, players) VALUES` +
+			strings.TrimSuffix(strings.Repeat(" (?, ?, ?),", n), ",") +
+			` ON CONFLICT(server_id, time) DO UPDATE SET players = excluded.players;`
+		if _, err := tx.ExecContext(ctx, q, args...); err != nil {
 			tx.Rollback() // TODO: handle error?
 			return err
 		}
+		points = points[n:]
 	}
 
 	return tx.Commit()
 }
 
-func (store *StorageSqlite) GetServerHistory(days int) ([]ServerPoint, error) {
+func (store *StorageSqlite) GetServerHistory(ctx context.Context, days int) ([]ServerPoint, error) {
 	var points []ServerPoint
-	delta := time.Now().AddDate(0, 0, -days)
+	delta := time.Now().AddDate(0, 0, -days).UTC()
 	q := `SELECT time,server_id,players FROM server_history WHERE time > ? ORDER BY time DESC, server_id ASC;`
-	err := store.Select(&points, q, delta)
+	err := store.SelectContext(ctx, &points, q, delta)
 	if err != nil {
 		return nil, err
 	}
 	return points, nil
 }
 
-func (store *StorageSqlite) GetSingleServerHistory(id string, days int) ([]ServerPoint, error) {
+func (store *StorageSqlite) GetSingleServerHistory(ctx context.Context, id string, days int) ([]ServerPoint, error) {
 	var points []ServerPoint
-	delta := time.Now().AddDate(0, 0, -days)
+	delta := time.Now().AddDate(0, 0, -days).UTC()
 	q := `SELECT time,server_id,players FROM server_history WHERE server_id = ? AND time > ? ORDER BY time DESC;`
-	err := store.Select(&points, q, id, delta)
+	err := store.SelectContext(ctx, &points, q, id, delta)
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+func (store *StorageSqlite) GetServerHistoryRange(ctx context.Context, id string, from, to time.Time) ([]ServerPoint, error) {
+	var points []ServerPoint
+	q := `SELECT time,server_id,players FROM server_history WHERE server_id = ? AND time > ? AND time <= ? ORDER BY time DESC;`
+	err := store.SelectContext(ctx, &points, q, id, from.UTC(), to.UTC())
 	if err != nil {
 		return nil, err
 	}
 	return points, nil
 }
+
+func (store *StorageSqlite) GetHistorySnapshot(ctx context.Context, t time.Time) ([]ServerPoint, error) {
+	var points []ServerPoint
+	q := `SELECT time,server_id,players FROM server_history WHERE time = (
+		SELECT time FROM server_history WHERE time <= ? ORDER BY time DESC LIMIT 1
+	) ORDER BY server_id ASC;`
+	err := store.SelectContext(ctx, &points, q, t.UTC())
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+func (store *StorageSqlite) DownsampleHistory(ctx context.Context, before time.Time, bucket time.Duration) error {
+	// Only downsample whole buckets, or the partial ones would get skewed
+	// averages on the next run
+	before = before.Truncate(bucket)
+
+	// Skips the history that's been downsampled already, so each run only
+	// has to go through what's new since the last one
+	done, err := store.getDownsampled(ctx)
+	if err != nil {
+		return err
+	}
+	var oldest []time.Time
+	q := `SELECT time FROM server_history WHERE time >= ? AND time < ? ORDER BY time ASC LIMIT 1;`
+	if err := store.SelectContext(ctx, &oldest, q, done.UTC(), before.UTC()); err != nil {
+		return err
+	}
+	if len(oldest) < 1 {
+		return nil
+	}
+	start := oldest[0].Truncate(bucket)
+	if start.Before(done) {
+		start = done
+	}
+
+	// Goes through the history in chunks, to avoid loading everything at once
+	chunk := bucket
+	if chunk < 24*time.Hour {
+		chunk = 24 * time.Hour / bucket * bucket
+	}
+	for from := start; from.Before(before); from = from.Add(chunk) {
+		to := from.Add(chunk)
+		if to.After(before) {
+			to = before
+		}
+		if err := store.downsampleChunk(ctx, from, to, bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns where the last DownsampleHistory stopped, or zero if it's never run
+func (store *StorageSqlite) getDownsampled(ctx context.Context) (time.Time, error) {
+	var value []string
+	q := `SELECT value FROM storage_meta WHERE key = ?;`
+	if err := store.SelectContext(ctx, &value, q, storageMetaDownsampled); err != nil {
+		return time.Time{}, err
+	}
+	if len(value) < 1 {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, value[0])
+}
+
+func (store *StorageSqlite) downsampleChunk(ctx context.Context, from, to time.Time, bucket time.Duration) error {
+	tx, err := store.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var points []ServerPoint
+	q := `SELECT time,server_id,players FROM server_history WHERE time >= ? AND time < ?;`
+	if err := tx.SelectContext(ctx, &points, q, from.UTC(), to.UTC()); err != nil {
+		tx.Rollback() // TODO: handle error?
+		return err
+	}
+
+	qDelete := `DELETE FROM server_history WHERE time >= ? AND time < ?;`
+	if _, err := tx.ExecContext(ctx, qDelete, from.UTC(), to.UTC()); err != nil {
+		tx.Rollback() // TODO: handle error?
+		return err
+	}
+
+	// The first bucket might already have a point from the last run, if the
+	// bucket size has changed since then
+	qInsert := `INSERT INTO server_history (time, server_id, players) VALUES(?, ?, ?)
+	ON CONFLICT(server_id, time) DO UPDATE SET players = excluded.players;`
+	for _, p := range averageHistory(points, bucket) {
+		if _, err := tx.ExecContext(ctx, qInsert, p.Time.UTC(), p.ServerID, p.Players); err != nil {
+			tx.Rollback() // TODO: handle error?
+			return err
+		}
+	}
+
+	// Saved together with the chunk, so an interrupted run continues from here
+	qMeta := `INSERT INTO storage_meta (key, value) VALUES(?, ?)
+	ON CONFLICT(key) DO UPDATE SET value = excluded.value;`
+	if _, err := tx.ExecContext(ctx, qMeta, storageMetaDownsampled, to.UTC().Format(time.RFC3339Nano)); err != nil {
+		tx.Rollback() // TODO: handle error?
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *StorageSqlite) RemoveOldHistory(ctx context.Context, before time.Time) error {
+	tx, err := store.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, q := range []string{
+		`DELETE FROM server_history WHERE time < ?;`,
+		`DELETE FROM server_count WHERE time < ?;`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, before.UTC()); err != nil {
+			tx.Rollback() // TODO: handle error?
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *StorageSqlite) GetTopServers(ctx context.Context, window time.Duration, metric TopMetric, limit int) ([]TopServer, error) {
+	agg, err := topMetricSQL(metric)
+	if err != nil {
+		return nil, err
+	}
+	var servers []TopServer
+	q := `SELECT e.id, e.title, ` + agg + ` AS value FROM server_history h
+	JOIN server_entry e ON e.id = h.server_id
+	WHERE h.time > ? GROUP BY e.id, e.title
+	ORDER BY value DESC, e.title ASC, e.id ASC LIMIT ?;`
+	err = store.SelectContext(ctx, &servers, q, time.Now().Add(-window).UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+func (store *StorageSqlite) SaveServerCount(ctx context.Context, count ServerCount) error {
+	q := `INSERT INTO server_count (time, servers) VALUES(?, ?);`
+	_, err := store.ExecContext(ctx, q, count.Time.UTC(), count.Servers)
+	return err
+}
+
+func (store *StorageSqlite) GetServerCounts(ctx context.Context, days int) ([]ServerCount, error) {
+	var counts []ServerCount
+	delta := time.Now().AddDate(0, 0, -days).UTC()
+	q := `SELECT time,servers FROM server_count WHERE time > ? ORDER BY time DESC;`
+	err := store.SelectContext(ctx, &counts, q, delta)
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func (store *StorageSqlite) SaveServerEvents(ctx context.Context, events []ServerEvent) error {
+	tx, err := store.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	q := `INSERT INTO server_event (time, server_id, kind) VALUES(?, ?, ?);`
+	stmt, err := tx.PrepareContext(ctx, q)
+	if err != nil {
+		tx.Rollback() // TODO: handle error?
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range events {
+		_, err := stmt.ExecContext(ctx, e.Time.UTC(), e.ServerID, e.Kind)
+		if err != nil {
+			tx.Rollback() // TODO: handle error?
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (store *StorageSqlite) GetServerEvents(ctx context.Context, id string, limit int) ([]ServerEvent, error) {
+	var events []ServerEvent
+	q := `SELECT time,server_id,kind FROM server_event WHERE server_id = ? ORDER BY time DESC LIMIT ?;`
+	err := store.SelectContext(ctx, &events, q, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (store *StorageSqlite) GetServerEventsSince(ctx context.Context, id string, since time.Time) ([]ServerEvent, error) {
+	var events []ServerEvent
+	q := `SELECT time,server_id,kind FROM server_event WHERE server_id = ? AND time > ? ORDER BY time DESC;`
+	err := store.SelectContext(ctx, &events, q, id, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (store *StorageSqlite) Stats(ctx context.Context) (StorageStats, error) {
+	var stats StorageStats
+	q := `SELECT
+		(SELECT COUNT(*) FROM server_entry) AS servers,
+		(SELECT COUNT(*) FROM server_history) AS history_points,
+		(SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()) AS size;`
+	if err := store.GetContext(ctx, &stats, q); err != nil {
+		return stats, err
+	}
+	// Selected one by one, as sqlite only parses the times for plain columns
+	// (and uses the index this way)
+	q = `SELECT time FROM server_history ORDER BY time ASC LIMIT 1;`
+	if err := store.GetContext(ctx, &stats.OldestPoint, q); err != nil && err != sql.ErrNoRows {
+		return stats, err
+	}
+	q = `SELECT time FROM server_history ORDER BY time DESC LIMIT 1;`
+	if err := store.GetContext(ctx, &stats.NewestPoint, q); err != nil && err != sql.ErrNoRows {
+		return stats, err
+	}
+	return stats, nil
+}
+
+func (store *StorageSqlite) GetMeta(ctx context.Context, key string) (string, error) {
+	var value string
+	q := `SELECT value FROM storage_meta WHERE key = ?;`
+	err := store.GetContext(ctx, &value, q, key)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+func (store *StorageSqlite) SaveMeta(ctx context.Context, key, value string) error {
+	q := `INSERT INTO storage_meta (key, value) VALUES(?, ?)
+	ON CONFLICT(key) DO UPDATE SET value = excluded.value;`
+	_, err := store.ExecContext(ctx, q, key, value)
+	return err
+}
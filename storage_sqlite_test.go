@@ -0,0 +1,149 @@
+package ss13_se
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestSqliteMakesDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data", "ss13")
+	path := filepath.Join(dir, "ss13.db")
+	store := NewStorageSqlite(path)
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&^0750 != 0 {
+		t.Errorf("got dir permissions %o, want at most 0750", perm)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("got %v for the database file, want it created", err)
+	}
+}
+
+func newTestSqlite(t testing.TB) *StorageSqlite {
+	t.Helper()
+	store := NewStorageSqlite(filepath.Join(t.TempDir(), "ss13.db"))
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+func TestStorageSqlite(t *testing.T) {
+	testStorage(t, newTestSqlite(t))
+}
+
+// Opens a database made with the initial scheme, before any of the migrations
+func TestSqliteMigrations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sqlx.ConnectContext(ctx, "sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, sqliteScheme); err != nil {
+		t.Fatal(err)
+	}
+	// The old versions saved the times in the local zone
+	now := time.Now().Truncate(time.Second).In(time.FixedZone("x", 9*3600))
+	first := now.Add(-48 * time.Hour)
+	peak := now.Add(-24 * time.Hour)
+	if _, err := db.ExecContext(ctx, `INSERT INTO server_entry (id, title, site_url, game_url, time, players) VALUES (?, ?, ?, ?, ?, ?);`,
+		"old", "Old Station", "", "byond://old.example.com:1337", now, 5); err != nil {
+		t.Fatal(err)
+	}
+	history := []ServerPoint{
+		{Time: first, ServerID: "old", Players: 3},
+		{Time: peak, ServerID: "old", Players: 30},
+		{Time: now, ServerID: "old", Players: 4},
+		// Duplicated by an old restart, the newer one is kept
+		{Time: now, ServerID: "old", Players: 5},
+	}
+	for _, p := range history {
+		if _, err := db.ExecContext(ctx, `INSERT INTO server_history (time, server_id, players) VALUES (?, ?, ?);`,
+			p.Time, p.ServerID, p.Players); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store := NewStorageSqlite(path)
+	if err := store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var version int
+	if err := store.GetContext(ctx, &version, `PRAGMA user_version;`); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("got user_version %d, want %d", version, len(sqliteMigrations))
+	}
+
+	s, err := store.GetServer(ctx, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.PeakPlayers != 30 || !s.PeakTime.Equal(peak) {
+		t.Errorf("got peak %d at %s, want 30 at %s from the history", s.PeakPlayers, s.PeakTime, peak)
+	}
+	if !s.FirstSeen.Equal(first) || !s.LastSeen.Equal(now) {
+		t.Errorf("got first seen %s and last seen %s, want %s and %s", s.FirstSeen, s.LastSeen, first, now)
+	}
+	if s.Source != "Exadv1/SpaceStation13" || s.FormerTitles == nil {
+		t.Errorf("got source %q and former titles %v, want the defaults", s.Source, s.FormerTitles)
+	}
+	points, err := store.GetServerHistoryRange(ctx, "old", time.Time{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3 || points[0].Players != 5 {
+		t.Errorf("got %+v, want the duplicated point removed", points)
+	}
+
+	// Opening again doesn't rerun anything
+	store.Close()
+	if err := store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSqliteHistoryChunk(t *testing.T) {
+	if n := 3 * sqliteHistoryChunk; n > sqliteMaxVariables {
+		t.Errorf("got %d variables per history INSERT, want at most %d", n, sqliteMaxVariables)
+	}
+}
+
+// Saves a scrape's worth of history, one point for each of ~300 servers
+func BenchmarkSaveServerHistory(b *testing.B) {
+	ctx := context.Background()
+	store := newTestSqlite(b)
+	now := time.Now().Truncate(time.Minute)
+	points := make([]ServerPoint, 300)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t := now.Add(time.Duration(i) * time.Minute)
+		for j := range points {
+			points[j] = ServerPoint{Time: t, ServerID: strconv.Itoa(j), Players: j % 50}
+		}
+		if err := store.SaveServerHistory(ctx, points); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package ss13_se
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs the Storage contract against an open, and empty, store.
+// The parts shares the store, so they each keeps to their own servers.
+func testStorage(t *testing.T, store Storage) {
+	// Postgres only keeps microseconds and the sqlite driver might return
+	// another timezone, so the times are compared with Equal
+	now := time.Now().Truncate(time.Second)
+	t.Run("servers", func(t *testing.T) {
+		testStorageServers(t, store, now)
+	})
+	t.Run("derived fields", func(t *testing.T) {
+		testStorageDerived(t, store, now)
+	})
+	t.Run("history", func(t *testing.T) {
+		testStorageHistory(t, store, now)
+	})
+	t.Run("large history", func(t *testing.T) {
+		testStorageLargeHistory(t, store, now)
+	})
+	t.Run("counts", func(t *testing.T) {
+		testStorageCounts(t, store, now)
+	})
+	t.Run("events", func(t *testing.T) {
+		testStorageEvents(t, store, now)
+	})
+	t.Run("meta", func(t *testing.T) {
+		testStorageMeta(t, store)
+	})
+	// Runs last, as it removes the old history of all servers
+	t.Run("retention", func(t *testing.T) {
+		testStorageRetention(t, store, now)
+	})
+}
+
+func testStorageServers(t *testing.T, store Storage, now time.Time) {
+	ctx := context.Background()
+	if _, err := store.GetServer(ctx, "srv-missing"); err != ErrNotFound {
+		t.Errorf("got %v for a missing server, want ErrNotFound", err)
+	}
+	if _, err := store.GetServerByGameURL(ctx, "byond://missing.example.com:1"); err != ErrNotFound {
+		t.Errorf("got %v for a missing game url, want ErrNotFound", err)
+	}
+
+	servers := []ServerEntry{
+		{ID: "srv-a", Title: "Storage Alpha", GameURL: "byond://alpha.example.com:1337", Players: 20, Time: now, Country: "SE"},
+		{ID: "srv-b", Title: "Storage Beta", GameURL: "byond://beta.example.com:2000", Players: 5, Time: now},
+		{ID: "srv-c", Title: "Another Server", Players: 0, Time: now},
+	}
+	if err := store.SaveServers(ctx, servers); err != nil {
+		t.Fatal(err)
+	}
+	// Saving again changes nothing
+	if err := store.SaveServers(ctx, servers); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.GetServer(ctx, "srv-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Title != "Storage Alpha" || s.Players != 20 || s.Country != "SE" || !s.Time.Equal(now) {
+		t.Errorf("got %+v, want the saved server", s)
+	}
+	if !s.FirstSeen.Equal(now) || !s.LastSeen.Equal(now) {
+		t.Errorf("got first seen %s and last seen %s, want both defaulting to %s", s.FirstSeen, s.LastSeen, now)
+	}
+
+	all, err := store.GetServers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Errorf("got %d servers, want 3", len(all))
+	}
+	if s, err := store.GetServerByGameURL(ctx, "byond://beta.example.com:2000"); err != nil || s.ID != "srv-b" {
+		t.Errorf("got %q and %v by the game url, want srv-b", s.ID, err)
+	}
+	found, err := store.SearchServers(ctx, "sToRaGe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Errorf("got %d servers from the search, want 2", len(found))
+	}
+
+	page, total, err := store.GetServersPage(ctx, ServerQuery{MinPlayers: 1, Limit: 1, ExcludeIDs: []string{"srv-x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(page) != 1 || page[0].ID != "srv-a" {
+		t.Errorf("got %d total and %v, want 2 and srv-a", total, serverTitles(page))
+	}
+	page, total, err = store.GetServersPage(ctx, ServerQuery{Sort: "title", Offset: 1, ExcludeIDs: []string{"srv-b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(page) != 1 || page[0].ID != "srv-a" {
+		t.Errorf("got %d total and %v, want 2 and srv-a", total, serverTitles(page))
+	}
+
+	// The history and events follows a renamed server
+	if err := store.SaveServerHistory(ctx, []ServerPoint{{Time: now, ServerID: "srv-c", Players: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveServerEvents(ctx, []ServerEvent{{ServerID: "srv-c", Kind: EventOnline, Time: now}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RenameServer(ctx, "srv-c", "srv-d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetServer(ctx, "srv-c"); err != ErrNotFound {
+		t.Errorf("got %v for the old ID, want ErrNotFound", err)
+	}
+	if s, err := store.GetServer(ctx, "srv-d"); err != nil || s.Title != "Another Server" {
+		t.Errorf("got %+v and %v for the new ID, want the renamed server", s, err)
+	}
+	points, err := store.GetServerHistoryRange(ctx, "srv-d", now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 {
+		t.Errorf("got %d points after the rename, want 1", len(points))
+	}
+
+	// And is removed with it
+	if err := store.RemoveServers(ctx, []ServerEntry{{ID: "srv-d"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetServer(ctx, "srv-d"); err != ErrNotFound {
+		t.Errorf("got %v for a removed server, want ErrNotFound", err)
+	}
+	points, err = store.GetServerHistoryRange(ctx, "srv-d", now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := store.GetServerEvents(ctx, "srv-d", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) > 0 || len(events) > 0 {
+		t.Errorf("got %d points and %d events for a removed server, want none", len(points), len(events))
+	}
+
+	stats, err := store.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Servers < 2 {
+		t.Errorf("got %d servers in the stats, want at least 2", stats.Servers)
+	}
+}
+
+// Saving a server again only replaces its derived fields with "greater" ones
+func testStorageDerived(t *testing.T, store Storage, now time.Time) {
+	ctx := context.Background()
+	first := now.Add(-48 * time.Hour)
+	peak := now.Add(-24 * time.Hour)
+	s := ServerEntry{
+		ID: "peak-a", Title: "Peak Station", Time: peak, Players: 50,
+		PeakPlayers: 50, PeakTime: peak, FirstSeen: first, LastSeen: peak,
+		FormerTitles: Titles{"Old Peak Station"},
+	}
+	if err := store.SaveServers(ctx, []ServerEntry{s}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later scrape with fewer players, and without the derived fields
+	lower := ServerEntry{ID: "peak-a", Title: "Peak Station", Time: now, Players: 3, PeakPlayers: 3, PeakTime: now}
+	if err := store.SaveServers(ctx, []ServerEntry{lower}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetServer(ctx, "peak-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Players != 3 || !got.Time.Equal(now) {
+		t.Errorf("got %d players at %s, want the new %d at %s", got.Players, got.Time, 3, now)
+	}
+	if got.PeakPlayers != 50 || !got.PeakTime.Equal(peak) {
+		t.Errorf("got peak %d at %s, want the old 50 at %s", got.PeakPlayers, got.PeakTime, peak)
+	}
+	if !got.FirstSeen.Equal(first) {
+		t.Errorf("got first seen %s, want the old %s", got.FirstSeen, first)
+	}
+	if !got.LastSeen.Equal(now) {
+		t.Errorf("got last seen %s, want the new %s", got.LastSeen, now)
+	}
+	if len(got.FormerTitles) != 1 || got.FormerTitles[0] != "Old Peak Station" {
+		t.Errorf("got former titles %v, want the old ones kept", got.FormerTitles)
+	}
+
+	// And a higher one replaces the peak
+	higher := ServerEntry{ID: "peak-a", Title: "Peak Station", Time: now, Players: 60, PeakPlayers: 60, PeakTime: now}
+	if err := store.SaveServers(ctx, []ServerEntry{higher}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.GetServer(ctx, "peak-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PeakPlayers != 60 || !got.PeakTime.Equal(now) || !got.FirstSeen.Equal(first) {
+		t.Errorf("got peak %d at %s and first seen %s, want the new peak and the old first seen", got.PeakPlayers, got.PeakTime, got.FirstSeen)
+	}
+}
+
+// Saves more points in one call than the SQL backends sends per statement,
+// like a scrape of a few hundred servers does
+func testStorageLargeHistory(t *testing.T, store Storage, now time.Time) {
+	ctx := context.Background()
+	for _, n := range []int{300, 301, 601} {
+		prefix := fmt.Sprintf("large-%d-", n)
+		var points []ServerPoint
+		for i := 0; i < n; i++ {
+			points = append(points, ServerPoint{Time: now.Add(-time.Duration(n) * time.Second), ServerID: prefix + fmt.Sprint(i), Players: i})
+		}
+		if err := store.SaveServerHistory(ctx, points); err != nil {
+			t.Fatalf("%d points: %s", n, err)
+		}
+
+		all, err := store.GetServerHistory(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]int)
+		for _, p := range all {
+			if strings.HasPrefix(p.ServerID, prefix) {
+				got[p.ServerID]++
+				if want := points[0].Time; !p.Time.Equal(want) {
+					t.Errorf("%d points: got time %s, want %s", n, p.Time, want)
+				}
+			}
+		}
+		if len(got) != n {
+			t.Errorf("got %d of the %d points back", len(got), n)
+		}
+		for id, count := range got {
+			if count != 1 {
+				t.Errorf("%d points: got %d points for %s, want 1", n, count, id)
+			}
+		}
+	}
+}
+
+func testStorageHistory(t *testing.T, store Storage, now time.Time) {
+	ctx := context.Background()
+	var points []ServerPoint
+	for i := 0; i < 5; i++ {
+		at := now.Add(time.Duration(-i) * time.Hour)
+		points = append(points,
+			ServerPoint{Time: at, ServerID: "hist-a", Players: 10 + i},
+			ServerPoint{Time: at, ServerID: "hist-b", Players: i},
+		)
+	}
+	if err := store.SaveServerHistory(ctx, points); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveServerHistory(ctx, nil); err != nil {
+		t.Errorf("got %v for saving no points, want nil", err)
+	}
+
+	// Like the same scrape saved twice, after a restart
+	if err := store.SaveServerHistory(ctx, points); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"hist-a", "hist-b"} {
+		got, err := store.GetServerHistoryRange(ctx, id, now.AddDate(0, 0, -1), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 5 {
+			t.Errorf("got %d points for %s after saving them twice, want 5", len(got), id)
+		}
+	}
+
+	// From is exclusive and to inclusive, newest first
+	got, err := store.GetServerHistoryRange(ctx, "hist-a", now.Add(-3*time.Hour), now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Players != 11 || got[1].Players != 12 || !got[0].Time.Equal(now.Add(-time.Hour)) {
+		t.Errorf("got %+v, want the two points from 1 and 2 hours ago", got)
+	}
+
+	got, err = store.GetSingleServerHistory(ctx, "hist-b", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 5 {
+		t.Errorf("got %d points for the last day, want 5", len(got))
+	}
+	for _, p := range got {
+		if p.ServerID != "hist-b" {
+			t.Errorf("got a point for %q, want only hist-b", p.ServerID)
+		}
+	}
+
+	snapshot, err := store.GetHistorySnapshot(ctx, now.Add(-90*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mine []ServerPoint
+	for _, p := range snapshot {
+		if p.ServerID == "hist-a" || p.ServerID == "hist-b" {
+			mine = append(mine, p)
+		}
+	}
+	if len(mine) != 2 || !mine[0].Time.Equal(now.Add(-2*time.Hour)) {
+		t.Errorf("got snapshot %+v, want the points from 2 hours ago", mine)
+	}
+	if snapshot, err := store.GetHistorySnapshot(ctx, now.AddDate(-50, 0, 0)); err != nil || len(snapshot) > 0 {
+		t.Errorf("got %d points and %v for an old snapshot, want none", len(snapshot), err)
+	}
+
+	// A newer point replaces the old one with the same time
+	if err := store.SaveServerHistory(ctx, []ServerPoint{{Time: now, ServerID: "hist-a", Players: 99}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.GetServerHistoryRange(ctx, "hist-a", now.Add(-time.Minute), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Players != 99 {
+		t.Errorf("got %+v, want a single replaced point", got)
+	}
+}
+
+func testStorageCounts(t *testing.T, store Storage, now time.Time) {
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		c := ServerCount{Time: now.Add(time.Duration(-i) * time.Hour), Servers: 100 + i}
+		if err := store.SaveServerCount(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counts, err := store.GetServerCounts(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 3 || counts[0].Servers != 100 || counts[2].Servers != 102 || !counts[0].Time.Equal(now) {
+		t.Errorf("got %+v, want the 3 counts with the newest first", counts)
+	}
+}
+
+func testStorageEvents(t *testing.T, store Storage, now time.Time) {
+	ctx := context.Background()
+	events := []ServerEvent{
+		{ServerID: "evt-a", Kind: EventOnline, Time: now.Add(-3 * time.Hour)},
+		{ServerID: "evt-a", Kind: EventOffline, Time: now.Add(-2 * time.Hour)},
+		{ServerID: "evt-a", Kind: EventOnline, Time: now.Add(-time.Hour)},
+		{ServerID: "evt-b", Kind: EventOnline, Time: now},
+	}
+	if err := store.SaveServerEvents(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.GetServerEvents(ctx, "evt-a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Kind != EventOnline || got[1].Kind != EventOffline || !got[0].Time.Equal(now.Add(-time.Hour)) {
+		t.Errorf("got %+v, want the 2 latest events with the newest first", got)
+	}
+	got, err = store.GetServerEventsSince(ctx, "evt-a", now.Add(-150*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("got %d events since 2.5 hours ago, want 2", len(got))
+	}
+}
+
+func testStorageRetention(t *testing.T, store Storage, now time.Time) {
+	ctx := context.Background()
+	// Aligned to the bucket, so the averages are known
+	day := now.Truncate(24*time.Hour).AddDate(0, 0, -10)
+	points := []ServerPoint{
+		{Time: day.Add(10 * time.Minute), ServerID: "ret-a", Players: 10},
+		{Time: day.Add(20 * time.Minute), ServerID: "ret-a", Players: 20},
+		{Time: day.Add(70 * time.Minute), ServerID: "ret-a", Players: 5},
+		{Time: day.AddDate(0, 0, -30), ServerID: "ret-a", Players: 1},
+		{Time: now, ServerID: "ret-a", Players: 7},
+	}
+	if err := store.SaveServerHistory(ctx, points); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveServerCount(ctx, ServerCount{Time: day.AddDate(0, 0, -30), Servers: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RemoveOldHistory(ctx, day.AddDate(0, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := store.GetServerCounts(ctx, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range counts {
+		if c.Time.Before(day) {
+			t.Errorf("got an old count from %s, want it removed", c.Time)
+		}
+	}
+
+	if err := store.DownsampleHistory(ctx, now.AddDate(0, 0, -1), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetServerHistoryRange(ctx, "ret-a", time.Time{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ServerPoint{
+		{Time: now, Players: 7},
+		{Time: day.Add(time.Hour), Players: 5},
+		{Time: day, Players: 15},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range got {
+		if !got[i].Time.Equal(want[i].Time) || got[i].Players != want[i].Players {
+			t.Errorf("got point %+v, want %+v", got[i], want[i])
+		}
+	}
+
+	// Running it again changes nothing
+	if err := store.DownsampleHistory(ctx, now.AddDate(0, 0, -1), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	again, err := store.GetServerHistoryRange(ctx, "ret-a", time.Time{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != len(got) {
+		t.Errorf("got %d points after downsampling again, want %d", len(again), len(got))
+	}
+
+	// The history before the last run isn't gone through again
+	late := []ServerPoint{
+		{Time: day.Add(130 * time.Minute), ServerID: "ret-a", Players: 2},
+		{Time: day.Add(140 * time.Minute), ServerID: "ret-a", Players: 4},
+	}
+	if err := store.SaveServerHistory(ctx, late); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DownsampleHistory(ctx, now.AddDate(0, 0, -1).Add(time.Hour), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	again, err = store.GetServerHistoryRange(ctx, "ret-a", day.Add(2*time.Hour), day.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 2 {
+		t.Errorf("got %d points from before the last run, want them left alone", len(again))
+	}
+
+	// Points with other timezones than the local one must still end up in
+	// the right buckets
+	zone := time.FixedZone("x", -5*3600)
+	base := now.Add(-12 * time.Hour).Truncate(time.Hour)
+	zoned := []ServerPoint{
+		{Time: base.Add(10 * time.Minute).In(zone), ServerID: "ret-z", Players: 10},
+		{Time: base.Add(20 * time.Minute).UTC(), ServerID: "ret-z", Players: 20},
+		{Time: base.Add(70 * time.Minute).In(zone), ServerID: "ret-z", Players: 5},
+		{Time: base.Add(130 * time.Minute).In(zone), ServerID: "ret-z", Players: 3},
+	}
+	if err := store.SaveServerHistory(ctx, zoned); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DownsampleHistory(ctx, base.Add(2*time.Hour), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.GetServerHistoryRange(ctx, "ret-z", base.Add(-time.Hour).In(zone), now.In(zone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []ServerPoint{
+		{Time: base.Add(130 * time.Minute), Players: 3},
+		{Time: base.Add(time.Hour), Players: 5},
+		{Time: base, Players: 15},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v with other timezones, want %+v", got, want)
+	}
+	for i := range got {
+		if !got[i].Time.Equal(want[i].Time) || got[i].Players != want[i].Players {
+			t.Errorf("got point %+v with other timezones, want %+v", got[i], want[i])
+		}
+	}
+}
+
+func testStorageMeta(t *testing.T, store Storage) {
+	ctx := context.Background()
+	if _, err := store.GetMeta(ctx, "test_key"); err != ErrNotFound {
+		t.Errorf("got error %v for a missing key, want ErrNotFound", err)
+	}
+	for _, value := range []string{"first", "second"} {
+		if err := store.SaveMeta(ctx, "test_key", value); err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.GetMeta(ctx, "test_key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != value {
+			t.Errorf("got %q, want %q", got, value)
+		}
+	}
+	if err := store.SaveMeta(ctx, "other_key", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.GetMeta(ctx, "other_key"); err != nil || got != "" {
+		t.Errorf("got %q and error %v for an empty value", got, err)
+	}
+	if got, _ := store.GetMeta(ctx, "test_key"); got != "second" {
+		t.Errorf("got %q after saving another key, want second", got)
+	}
+}
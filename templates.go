@@ -1,13 +1,68 @@
 package ss13_se
 
 import (
+	"embed"
+	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
 )
 
-func loadTemplates() (map[string]*template.Template, error) {
+//go:embed templates static
+var embeddedAssets embed.FS
+
+// Pages in the templates dir, each one parsed together with the base template
+var tmplList = []string{
+	"index",
+	"server",
+	"leaderboard",
+	"stats",
+	"favorites",
+}
+
+// Pages parsed on their own, without the base template
+var standaloneTmplList = []string{
+	"embed",
+}
+
+// The error page is rendered by the handler wrapper, which doesn't have the
+// App's templates, so it's parsed once from the embedded assets instead
+var errorTmpl = template.Must(template.ParseFS(embeddedAssets, "templates/error.html"))
+
+func loadTemplates(assets fs.FS, basePath string) (map[string]*template.Template, error) {
+	funcs := template.FuncMap{
+		// The BasePath, to prefix the internal links with
+		"base": func() string {
+			return basePath
+		},
+	}
+	for k, fn := range tmplFuncs {
+		funcs[k] = fn
+	}
+
+	base, err := fs.ReadFile(assets, "templates/base.html")
+	if err != nil {
+		return nil, err
+	}
+
 	tmpls := make(map[string]*template.Template)
-	for name, src := range tmplList {
-		t, err := parseTemplate(tmplBase, src)
+	for _, name := range tmplList {
+		src, err := fs.ReadFile(assets, "templates/"+name+".html")
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseTemplate(funcs, string(base), string(src))
+		if err != nil {
+			return nil, err
+		}
+		tmpls[name] = t
+	}
+	for _, name := range standaloneTmplList {
+		src, err := fs.ReadFile(assets, "templates/"+name+".html")
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseTemplate(funcs, string(src))
 		if err != nil {
 			return nil, err
 		}
@@ -16,9 +71,16 @@ func loadTemplates() (map[string]*template.Template, error) {
 	return tmpls, nil
 }
 
-func parseTemplate(src ...string) (*template.Template, error) {
+// Helpers available in all templates (along with "base", see loadTemplates)
+var tmplFuncs = template.FuncMap{
+	"inc": func(i int) int {
+		return i + 1
+	},
+}
+
+func parseTemplate(funcs template.FuncMap, src ...string) (*template.Template, error) {
 	var err error
-	t := template.New("*")
+	t := template.New("*").Funcs(funcs)
 	for _, s := range src {
 		t, err = t.Parse(s)
 		if err != nil {
@@ -28,148 +90,20 @@ func parseTemplate(src ...string) (*template.Template, error) {
 	return t, nil
 }
 
-// Using the awesome style from http://bettermotherfuckingwebsite.com/
-
-const tmplBase string = `<!DOCTYPE html>
-<html>
-        <head>
-                <meta charset="utf-8">
-		<link rel="stylesheet" href="/static/style.css" type="text/css">
-                <title>
-                        {{block "title" .}}NO TITLE{{end}} | ss13.se
-                </title>
-        </head>
-        <body>
-                <header>
-			<a href="/">ss13.se</a>
-			<a href="/server/{{.Hub.ID}}">Global stats</a>
-			<p class="right">Last updated: {{.Hub.LastUpdated}}</p>
-                </header>
-
-                <section id="body">
-                        {{block "body" .}}NO BODY{{end}}
-                </section>
-
-                <footer>
-			<a href="https://github.com/lmas/ss13_se">Source</a>
-                </footer>
-        </body>
-</html>`
-
-var tmplList = map[string]string{
-	"style": `
-* {
-	padding: 0px;
-	margin: 0px;
-}
-body {
-	margin: 0px auto;
-	max-width: 1024px;
-	font-size: 18px;
-	padding: 0 10px;
-	line-height: 1.6;
-	color: #444;
-	background-color: #fff;
-}
-h1, h2 {
-	text-align: center;
-}
-a, a:hover, a:visited {
-	color: #444;
-	text-decoration: none;
-}
-a:hover {
-	color: #000;
-}
-img {
-	display: block;
-	margin: auto;
-}
-header {
-	margin-bottom: 40px;
-	padding: 10px 20px;
-	color: #fff;
-	background-color: #444;
-	border-bottom-left-radius: 5px;
-	border-bottom-right-radius: 5px;
-}
-header a, header a:hover, header a:visited {
-	color: #fff;
-	text-decoration: none;
-	display: inline;
-	padding-right: 40px;
-}
-footer {
-	margin-top: 40px;
-	padding: 10px;
-	text-align: center;
-	font-size: 12px;
-}
-.button a {
-	background-color: #444;
-	color: #fff;
-	border-radius: 5px;
-	padding: 5px 10px;
-	text-decoration: none;
-}
-.button a:hover {
-	background-color: #888;
-}
-.left {
-	float: left;
-}
-.right {
-	float: right;
-}
-.hide td, .hide a {
-	color: #bbb;
-}
-`,
-	"index": `{{define "title"}}Index{{end}}
-{{define "body"}}
-<h1>Servers</h1>
-<table>
-	<thead><tr>
-		<td>Players</td>
-		<td>Server</td>
-	</tr></thead>
-
-	<tbody>
-	{{range .Servers}}
-		<tr {{if lt .Players 1}}class="hide"{{end}}>
-			<td>{{.Players}}</td>
-			<td><a href="/server/{{.ID}}">{{.Title}}</a></td>
-		</tr>
-	{{else}}
-		<tr><td>0</td><td>Sorry, no servers yet!</td></tr>
-	{{end}}
-	</tbody>
-</table>
-{{end}}
-`,
-
-	"server": `{{define "title"}}{{.Server.Title}}{{end}}
-{{define "body"}}
-<h1>{{.Server.Title}}</h1>
-
-{{if .Server.SiteURL}}
-	<span class="button"><a href="{{.Server.SiteURL}}">Website</a></span>
-{{end}}
-
-{{if .Server.ByondURL}}
-	<span class="button"><a href="{{.Server.ByondURL}}">Join game</a></span>
-{{end}}
-
-<p>Current players: {{.Server.Players}}</p>
+func (a *App) renderTemplate(w io.Writer, name string, data interface{}) error {
+	templates := a.templates
+	if a.conf.DevMode {
+		// Reload the templates on each render, for live editing
+		var err error
+		templates, err = loadTemplates(a.assets, a.conf.BasePath)
+		if err != nil {
+			return err
+		}
+	}
 
-<h2>Daily History</h2>
-<img src="/server/{{.Server.ID}}/daily" alt="Unable to show a pretty graph">
-<h2>Weekly History</h2>
-<img src="/server/{{.Server.ID}}/weekly" alt="Unable to show a pretty graph">
-<h2>Average per day</h2>
-<img src="/server/{{.Server.ID}}/averagedaily" alt="Unable to show a pretty graph">
-<h2>Average per hour</h2>
-<img src="/server/{{.Server.ID}}/averagehourly" alt="Unable to show a pretty graph">
-{{end}}
-`,
+	t, ok := templates[name]
+	if !ok {
+		return fmt.Errorf("unknown template: %s", name)
+	}
+	return t.Execute(w, data)
 }
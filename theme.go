@@ -0,0 +1,90 @@
+package ss13_se
+
+import (
+	"net/http"
+	"time"
+
+	chart "github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
+)
+
+// Color theme for the pages and charts. The empty theme follows the
+// browser's prefers-color-scheme, which only the stylesheet knows about, so
+// the charts are light then.
+type Theme string
+
+const (
+	ThemeLight Theme = "light"
+	ThemeDark  Theme = "dark"
+)
+
+const themeCookie = "theme"
+
+// Same colors as the dark theme in style.css
+var (
+	darkBackground = drawing.ColorFromHex("1e1e1e")
+	darkText       = drawing.ColorFromHex("ccc")
+)
+
+// Returns the theme if it's a valid one, or else the empty theme
+func parseTheme(s string) Theme {
+	switch t := Theme(s); t {
+	case ThemeLight, ThemeDark:
+		return t
+	}
+	return ""
+}
+
+// Returns the theme picked with the "theme" query param, which is also
+// remembered in a cookie for the following pages, or else from the cookie.
+func readTheme(w http.ResponseWriter, r *http.Request) Theme {
+	if t := parseTheme(r.URL.Query().Get("theme")); t != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     themeCookie,
+			Value:    string(t),
+			Path:     basePath(r) + "/",
+			Expires:  time.Now().AddDate(1, 0, 0),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return t
+	}
+	if c, err := r.Cookie(themeCookie); err == nil {
+		return parseTheme(c.Value)
+	}
+	return ""
+}
+
+// Returns the chart with the colors changed to match the theme.
+// Only the dark theme changes anything, as the charts are light by default.
+func themeChart(c renderableChart, t Theme) renderableChart {
+	if t != ThemeDark {
+		return c
+	}
+	bg := chart.Style{FillColor: darkBackground}
+	text := func(s chart.Style) chart.Style {
+		s.FontColor = darkText
+		s.StrokeColor = darkText
+		return s
+	}
+	switch c := c.(type) {
+	case chart.Chart:
+		c.Background = bg.InheritFrom(c.Background)
+		c.Canvas = bg.InheritFrom(c.Canvas)
+		c.XAxis.Style = text(c.XAxis.Style)
+		c.YAxis.Style = text(c.YAxis.Style)
+		c.YAxis.NameStyle = text(c.YAxis.NameStyle)
+		c.YAxisSecondary.Style = text(c.YAxisSecondary.Style)
+		c.YAxisSecondary.NameStyle = text(c.YAxisSecondary.NameStyle)
+		// NOTE: the thin legend is left as it is, as it always draws a white
+		// background no matter the style
+		return c
+	case chart.BarChart:
+		c.Background = bg.InheritFrom(c.Background)
+		c.Canvas = bg.InheritFrom(c.Canvas)
+		c.XAxis = text(c.XAxis)
+		c.YAxis.Style = text(c.YAxis.Style)
+		return c
+	}
+	return c
+}
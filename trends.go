@@ -0,0 +1,68 @@
+package ss13_se
+
+import (
+	"context"
+	"time"
+)
+
+// How far back the trends on the index compares the players with
+const trendWindow = time.Hour
+
+// Change in players of a server since about trendWindow ago
+type Trend int
+
+// Returns an arrow for the direction of the trend, or nothing if unchanged
+func (t Trend) Arrow() string {
+	switch {
+	case t > 0:
+		return "▲"
+	case t < 0:
+		return "▼"
+	}
+	return ""
+}
+
+func (t Trend) Abs() int {
+	if t < 0 {
+		return int(-t)
+	}
+	return int(t)
+}
+
+// Updates the trends for the current servers, using the history from the
+// scrape closest to trendWindow ago. It's only done once per update, so the
+// index doesn't have to touch the history at all.
+func (a *App) updateTrends(ctx context.Context, t time.Time, servers []ServerEntry) error {
+	target := t.Add(-trendWindow)
+	points, err := a.store.GetHistorySnapshot(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	trends := make(map[string]Trend)
+	// Skips the trends if the snapshot is too old, after some downtime, as
+	// they wouldn't say much about the last hour then
+	if len(points) > 0 && target.Sub(points[0].Time) <= 2*a.conf.ScrapeTimeout {
+		before := make(map[string]int)
+		for _, p := range points {
+			before[p.ServerID] = p.Players
+		}
+		for _, s := range servers {
+			if old, found := before[s.ID]; found {
+				trends[s.ID] = Trend(s.Players - old)
+			}
+		}
+	}
+
+	a.trendLock.Lock()
+	a.trends = trends
+	a.trendLock.Unlock()
+	return nil
+}
+
+// Returns the latest trends per server ID, which must not be modified
+func (a *App) getTrends() map[string]Trend {
+	a.trendLock.RLock()
+	defer a.trendLock.RUnlock()
+	return a.trends
+}
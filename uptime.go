@@ -0,0 +1,116 @@
+package ss13_se
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How far back the uptime percentage goes
+const uptimeDays = 30
+
+// Reliability stats of a server, from its online and offline events.
+// It's only approximate, as the app itself can't see anything while it's down.
+type Uptime struct {
+	Online bool
+	// Since the server was first seen
+	Age time.Duration
+	// Since the server last went online or offline (or was first seen, if
+	// it's never done either)
+	Current time.Duration
+	// How much of the last uptimeDays the server was online, in percent
+	Percent float64
+}
+
+func (u Uptime) AgeText() string {
+	return formatDuration(u.Age)
+}
+
+func (u Uptime) CurrentText() string {
+	return formatDuration(u.Current)
+}
+
+func (u Uptime) PercentText() string {
+	return fmt.Sprintf("%.1f%%", u.Percent)
+}
+
+// Returns the uptime of the server at now, from its latest event and the
+// events since "since" (both sorted with the newest first).
+// NOTE: empty servers counts as offline, same as with the events.
+func calcUptime(s ServerEntry, latest, events []ServerEvent, since, now time.Time) Uptime {
+	first := s.FirstSeenAt()
+	u := Uptime{
+		Online:  s.Players > 0,
+		Age:     now.Sub(first),
+		Current: now.Sub(first),
+	}
+	if len(latest) > 0 {
+		u.Online = latest[0].Kind == EventOnline
+		u.Current = now.Sub(latest[0].Time)
+	}
+
+	start := since
+	if first.After(start) {
+		start = first
+	}
+	total := now.Sub(start)
+	if total <= 0 {
+		return u
+	}
+
+	// Walks the events from the oldest one, summing the time spent online.
+	// The state before the oldest event is the opposite of what it changed to.
+	online := u.Online
+	if len(events) > 0 {
+		online = events[len(events)-1].Kind != EventOnline
+	}
+	var up time.Duration
+	last := start
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		if e.Time.Before(start) {
+			online = e.Kind == EventOnline
+			continue
+		}
+		if online {
+			up += e.Time.Sub(last)
+		}
+		last = e.Time
+		online = e.Kind == EventOnline
+	}
+	if online {
+		up += now.Sub(last)
+	}
+	u.Percent = float64(up) / float64(total) * 100
+	return u
+}
+
+// Returns the duration in days and hours, or hours and minutes if it's shorter
+// than a day, like "3 days 4 hours"
+func formatDuration(d time.Duration) string {
+	units := func(big, small time.Duration, bigName, smallName string) string {
+		s := plural(int(d/big), bigName)
+		if n := int(d % big / small); n > 0 {
+			s += " " + plural(n, smallName)
+		}
+		return s
+	}
+	switch {
+	case d < time.Hour:
+		return plural(int(d/time.Minute), "minute")
+	case d < 24*time.Hour:
+		return units(time.Hour, time.Minute, "hour", "minute")
+	}
+	return units(24*time.Hour, time.Hour, "day", "hour")
+}
+
+// Returns the uptime of a server, using the latest of its events
+func (a *App) getUptime(r *http.Request, s ServerEntry, latest []ServerEvent) (Uptime, error) {
+	now := time.Now()
+	since := now.AddDate(0, 0, -uptimeDays)
+	events, err := a.store.GetServerEventsSince(r.Context(), s.ID, since)
+	if err != nil {
+		return Uptime{}, err
+	}
+	return calcUptime(s, latest, events, since, now), nil
+}